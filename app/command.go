@@ -0,0 +1,452 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CmdFlags tags a few cross-cutting properties of a command that used to be
+// decided ad hoc inside the old switch statement: whether it mutates the
+// dataset (and so must be logged to the AOF and replicated) and whether it's
+// an administrative command kept out of scripting/transactions.
+type CmdFlags int
+
+const (
+	CmdReadOnly CmdFlags = 1 << iota
+	CmdWrite
+	CmdAdmin
+)
+
+// CommandSpec describes one command: its name, arity and handler, so it can
+// be looked up, arity-checked, and (for MULTI/EXEC) queued and replayed
+// uniformly instead of via a hand-written switch case per command.
+//
+// Arity mirrors Redis's own convention: it counts the command name itself.
+// A positive value is the exact number of arguments required; a negative
+// value is a minimum, for commands that accept a variable number of further
+// arguments.
+type CommandSpec struct {
+	Name    string
+	Arity   int
+	Flags   CmdFlags
+	Handler func(*Client, []Value) Value
+}
+
+func (spec *CommandSpec) checkArity(args []Value) bool {
+	got := len(args) + 1
+	if spec.Arity >= 0 {
+		return got == spec.Arity
+	}
+	return got >= -spec.Arity
+}
+
+// newCommandTable builds the registry of every command that fits the
+// "take the client and its arguments, return one reply" shape. A handful of
+// commands that stream multiple replies or mutate connection-level state
+// directly (SUBSCRIBE and friends, PSYNC, MULTI/EXEC/DISCARD/WATCH/UNWATCH)
+// are special-cased in handleConnection instead of living here.
+func newCommandTable(server *Server) map[string]*CommandSpec {
+	storage := server.storage
+	table := make(map[string]*CommandSpec)
+	register := func(spec CommandSpec) {
+		table[spec.Name] = &spec
+	}
+
+	register(CommandSpec{Name: "ping", Arity: -1, Flags: CmdReadOnly, Handler: func(c *Client, args []Value) Value {
+		return SimpleStringValue("PONG")
+	}})
+
+	register(CommandSpec{Name: "echo", Arity: 2, Flags: CmdReadOnly, Handler: func(c *Client, args []Value) Value {
+		return BulkStringValue(args[0].String())
+	}})
+
+	register(CommandSpec{Name: "hello", Arity: -1, Flags: CmdReadOnly, Handler: handleHello})
+
+	register(CommandSpec{Name: "set", Arity: -3, Flags: CmdWrite, Handler: func(c *Client, args []Value) Value {
+		if len(args) > 2 {
+			if args[2].String() != "px" || len(args) < 4 {
+				return ErrorValue(fmt.Sprintf("ERR invalid option for set: %s", args[2].String()))
+			}
+			expiry, err := strconv.Atoi(args[3].String())
+			if err != nil {
+				return ErrorValue(fmt.Sprintf("ERR invalid PX value: %s", args[3].String()))
+			}
+			storage.SetWithExpiry(args[0].String(), args[1].String(), time.Duration(expiry)*time.Millisecond)
+		} else {
+			storage.Set(args[0].String(), args[1].String())
+		}
+		return SimpleStringValue("OK")
+	}})
+
+	register(CommandSpec{Name: "get", Arity: 2, Flags: CmdReadOnly, Handler: func(c *Client, args []Value) Value {
+		value, found := storage.Get(args[0].String())
+		if !found {
+			return NullValue()
+		}
+		return BulkStringValue(value)
+	}})
+
+	register(CommandSpec{Name: "del", Arity: -2, Flags: CmdWrite, Handler: func(c *Client, args []Value) Value {
+		deleted := int64(0)
+		for _, arg := range args {
+			if storage.Del(arg.String()) {
+				deleted++
+			}
+		}
+		return IntegerValue(deleted)
+	}})
+
+	register(CommandSpec{Name: "keys", Arity: 2, Flags: CmdReadOnly, Handler: func(c *Client, args []Value) Value {
+		matches := storage.Keys(args[0].String())
+		reply := make([]Value, len(matches))
+		for i, key := range matches {
+			reply[i] = BulkStringValue(key)
+		}
+		return ArrayValue(reply)
+	}})
+
+	register(CommandSpec{Name: "lpush", Arity: -3, Flags: CmdWrite, Handler: func(c *Client, args []Value) Value {
+		n, err := storage.LPush(args[0].String(), stringArgs(args[1:])...)
+		if err != nil {
+			return ErrorValue(err.Error())
+		}
+		return IntegerValue(int64(n))
+	}})
+
+	register(CommandSpec{Name: "rpush", Arity: -3, Flags: CmdWrite, Handler: func(c *Client, args []Value) Value {
+		n, err := storage.RPush(args[0].String(), stringArgs(args[1:])...)
+		if err != nil {
+			return ErrorValue(err.Error())
+		}
+		return IntegerValue(int64(n))
+	}})
+
+	register(CommandSpec{Name: "lpop", Arity: 2, Flags: CmdWrite, Handler: func(c *Client, args []Value) Value {
+		value, found, err := storage.LPop(args[0].String())
+		if err != nil {
+			return ErrorValue(err.Error())
+		}
+		if !found {
+			return NullValue()
+		}
+		return BulkStringValue(value)
+	}})
+
+	register(CommandSpec{Name: "rpop", Arity: 2, Flags: CmdWrite, Handler: func(c *Client, args []Value) Value {
+		value, found, err := storage.RPop(args[0].String())
+		if err != nil {
+			return ErrorValue(err.Error())
+		}
+		if !found {
+			return NullValue()
+		}
+		return BulkStringValue(value)
+	}})
+
+	register(CommandSpec{Name: "lrange", Arity: 4, Flags: CmdReadOnly, Handler: func(c *Client, args []Value) Value {
+		start, err1 := strconv.Atoi(args[1].String())
+		stop, err2 := strconv.Atoi(args[2].String())
+		if err1 != nil || err2 != nil {
+			return ErrorValue("ERR value is not an integer or out of range")
+		}
+		elements, err := storage.LRange(args[0].String(), start, stop)
+		if err != nil {
+			return ErrorValue(err.Error())
+		}
+		return ArrayValue(bulkStrings(elements))
+	}})
+
+	register(CommandSpec{Name: "llen", Arity: 2, Flags: CmdReadOnly, Handler: func(c *Client, args []Value) Value {
+		n, err := storage.LLen(args[0].String())
+		if err != nil {
+			return ErrorValue(err.Error())
+		}
+		return IntegerValue(int64(n))
+	}})
+
+	register(CommandSpec{Name: "hset", Arity: -4, Flags: CmdWrite, Handler: func(c *Client, args []Value) Value {
+		if len(args)%2 != 1 {
+			return ErrorValue("ERR wrong number of arguments for 'hset' command")
+		}
+		fields := make(map[string]string, (len(args)-1)/2)
+		for i := 1; i < len(args); i += 2 {
+			fields[args[i].String()] = args[i+1].String()
+		}
+		created, err := storage.HSet(args[0].String(), fields)
+		if err != nil {
+			return ErrorValue(err.Error())
+		}
+		return IntegerValue(int64(created))
+	}})
+
+	register(CommandSpec{Name: "hget", Arity: 3, Flags: CmdReadOnly, Handler: func(c *Client, args []Value) Value {
+		value, found, err := storage.HGet(args[0].String(), args[1].String())
+		if err != nil {
+			return ErrorValue(err.Error())
+		}
+		if !found {
+			return NullValue()
+		}
+		return BulkStringValue(value)
+	}})
+
+	register(CommandSpec{Name: "hdel", Arity: -3, Flags: CmdWrite, Handler: func(c *Client, args []Value) Value {
+		removed, err := storage.HDel(args[0].String(), stringArgs(args[1:])...)
+		if err != nil {
+			return ErrorValue(err.Error())
+		}
+		return IntegerValue(int64(removed))
+	}})
+
+	register(CommandSpec{Name: "hgetall", Arity: 2, Flags: CmdReadOnly, Handler: func(c *Client, args []Value) Value {
+		fields, err := storage.HGetAll(args[0].String())
+		if err != nil {
+			return ErrorValue(err.Error())
+		}
+		reply := make([]Value, 0, len(fields)*2)
+		for field, value := range fields {
+			reply = append(reply, BulkStringValue(field), BulkStringValue(value))
+		}
+		return ArrayValue(reply)
+	}})
+
+	register(CommandSpec{Name: "hincrby", Arity: 4, Flags: CmdWrite, Handler: func(c *Client, args []Value) Value {
+		delta, err := strconv.ParseInt(args[2].String(), 10, 64)
+		if err != nil {
+			return ErrorValue("ERR value is not an integer or out of range")
+		}
+		result, err := storage.HIncrBy(args[0].String(), args[1].String(), delta)
+		if err != nil {
+			return ErrorValue(err.Error())
+		}
+		return IntegerValue(result)
+	}})
+
+	register(CommandSpec{Name: "sadd", Arity: -3, Flags: CmdWrite, Handler: func(c *Client, args []Value) Value {
+		added, err := storage.SAdd(args[0].String(), stringArgs(args[1:])...)
+		if err != nil {
+			return ErrorValue(err.Error())
+		}
+		return IntegerValue(int64(added))
+	}})
+
+	register(CommandSpec{Name: "srem", Arity: -3, Flags: CmdWrite, Handler: func(c *Client, args []Value) Value {
+		removed, err := storage.SRem(args[0].String(), stringArgs(args[1:])...)
+		if err != nil {
+			return ErrorValue(err.Error())
+		}
+		return IntegerValue(int64(removed))
+	}})
+
+	register(CommandSpec{Name: "smembers", Arity: 2, Flags: CmdReadOnly, Handler: func(c *Client, args []Value) Value {
+		members, err := storage.SMembers(args[0].String())
+		if err != nil {
+			return ErrorValue(err.Error())
+		}
+		return ArrayValue(bulkStrings(members))
+	}})
+
+	register(CommandSpec{Name: "sinter", Arity: -2, Flags: CmdReadOnly, Handler: func(c *Client, args []Value) Value {
+		members, err := storage.SInter(stringArgs(args)...)
+		if err != nil {
+			return ErrorValue(err.Error())
+		}
+		return ArrayValue(bulkStrings(members))
+	}})
+
+	register(CommandSpec{Name: "sunion", Arity: -2, Flags: CmdReadOnly, Handler: func(c *Client, args []Value) Value {
+		members, err := storage.SUnion(stringArgs(args)...)
+		if err != nil {
+			return ErrorValue(err.Error())
+		}
+		return ArrayValue(bulkStrings(members))
+	}})
+
+	register(CommandSpec{Name: "zadd", Arity: -4, Flags: CmdWrite, Handler: func(c *Client, args []Value) Value {
+		if len(args)%2 != 1 {
+			return ErrorValue("ERR wrong number of arguments for 'zadd' command")
+		}
+		members := make(map[string]float64, (len(args)-1)/2)
+		for i := 1; i < len(args); i += 2 {
+			score, err := strconv.ParseFloat(args[i].String(), 64)
+			if err != nil {
+				return ErrorValue("ERR value is not a valid float")
+			}
+			members[args[i+1].String()] = score
+		}
+		added, err := storage.ZAdd(args[0].String(), members)
+		if err != nil {
+			return ErrorValue(err.Error())
+		}
+		return IntegerValue(int64(added))
+	}})
+
+	register(CommandSpec{Name: "zrange", Arity: 4, Flags: CmdReadOnly, Handler: func(c *Client, args []Value) Value {
+		start, err1 := strconv.Atoi(args[1].String())
+		stop, err2 := strconv.Atoi(args[2].String())
+		if err1 != nil || err2 != nil {
+			return ErrorValue("ERR value is not an integer or out of range")
+		}
+		members, err := storage.ZRange(args[0].String(), start, stop)
+		if err != nil {
+			return ErrorValue(err.Error())
+		}
+		return ArrayValue(bulkStrings(members))
+	}})
+
+	register(CommandSpec{Name: "zrangebyscore", Arity: 4, Flags: CmdReadOnly, Handler: func(c *Client, args []Value) Value {
+		min, err1 := strconv.ParseFloat(args[1].String(), 64)
+		max, err2 := strconv.ParseFloat(args[2].String(), 64)
+		if err1 != nil || err2 != nil {
+			return ErrorValue("ERR min or max is not a float")
+		}
+		members, err := storage.ZRangeByScore(args[0].String(), min, max)
+		if err != nil {
+			return ErrorValue(err.Error())
+		}
+		return ArrayValue(bulkStrings(members))
+	}})
+
+	register(CommandSpec{Name: "zrank", Arity: 3, Flags: CmdReadOnly, Handler: func(c *Client, args []Value) Value {
+		rank, found, err := storage.ZRank(args[0].String(), args[1].String())
+		if err != nil {
+			return ErrorValue(err.Error())
+		}
+		if !found {
+			return NullValue()
+		}
+		return IntegerValue(int64(rank))
+	}})
+
+	register(CommandSpec{Name: "zincrby", Arity: 4, Flags: CmdWrite, Handler: func(c *Client, args []Value) Value {
+		delta, err := strconv.ParseFloat(args[1].String(), 64)
+		if err != nil {
+			return ErrorValue("ERR value is not a valid float")
+		}
+		result, err := storage.ZIncrBy(args[0].String(), args[2].String(), delta)
+		if err != nil {
+			return ErrorValue(err.Error())
+		}
+		return BulkStringValue(strconv.FormatFloat(result, 'g', -1, 64))
+	}})
+
+	register(CommandSpec{Name: "save", Arity: 1, Flags: CmdAdmin, Handler: func(c *Client, args []Value) Value {
+		if err := server.rdb.Save(storage); err != nil {
+			return ErrorValue(fmt.Sprintf("ERR %s", err))
+		}
+		storage.ResetDirty()
+		return SimpleStringValue("OK")
+	}})
+
+	register(CommandSpec{Name: "bgsave", Arity: 1, Flags: CmdAdmin, Handler: func(c *Client, args []Value) Value {
+		go func() {
+			if err := server.rdb.Save(storage); err == nil {
+				storage.ResetDirty()
+			}
+		}()
+		return SimpleStringValue("Background saving started")
+	}})
+
+	register(CommandSpec{Name: "lastsave", Arity: 1, Flags: CmdAdmin, Handler: func(c *Client, args []Value) Value {
+		return IntegerValue(server.rdb.LastSave())
+	}})
+
+	register(CommandSpec{Name: "bgrewriteaof", Arity: 1, Flags: CmdAdmin, Handler: func(c *Client, args []Value) Value {
+		if server.aof == nil {
+			return ErrorValue("ERR background AOF rewrite requires --appendonly")
+		}
+		go server.aof.Save(storage)
+		return SimpleStringValue("Background append only file rewriting started")
+	}})
+
+	register(CommandSpec{Name: "replconf", Arity: -1, Flags: CmdAdmin, Handler: func(c *Client, args []Value) Value {
+		return SimpleStringValue("OK")
+	}})
+
+	register(CommandSpec{Name: "replicaof", Arity: 3, Flags: CmdAdmin, Handler: func(c *Client, args []Value) Value {
+		host, port := args[0].String(), args[1].String()
+		if strings.EqualFold(host, "no") && strings.EqualFold(port, "one") {
+			server.repl.StopReplicaOf()
+		} else {
+			server.repl.StartReplicaOf(host, port, storage)
+		}
+		return SimpleStringValue("OK")
+	}})
+
+	register(CommandSpec{Name: "publish", Arity: 3, Flags: CmdReadOnly, Handler: func(c *Client, args []Value) Value {
+		receivers := server.pubsub.Publish(args[0].String(), args[1].String())
+		return IntegerValue(int64(receivers))
+	}})
+
+	register(CommandSpec{Name: "pubsub", Arity: -2, Flags: CmdReadOnly, Handler: func(c *Client, args []Value) Value {
+		return handlePubSubIntrospect(server.pubsub, args)
+	}})
+
+	register(CommandSpec{Name: "config", Arity: -3, Flags: CmdAdmin, Handler: func(c *Client, args []Value) Value {
+		return handleConfig(server, args)
+	}})
+
+	register(CommandSpec{Name: "command", Arity: -1, Flags: CmdReadOnly, Handler: func(c *Client, args []Value) Value {
+		return handleCommandIntrospect(table, args)
+	}})
+
+	return table
+}
+
+func bulkStrings(values []string) []Value {
+	out := make([]Value, len(values))
+	for i, v := range values {
+		out[i] = BulkStringValue(v)
+	}
+	return out
+}
+
+// handleCommandIntrospect implements COMMAND, COMMAND COUNT and COMMAND
+// INFO [name ...], reading straight from the registry that backs dispatch.
+func handleCommandIntrospect(table map[string]*CommandSpec, args []Value) Value {
+	if len(args) == 0 {
+		reply := make([]Value, 0, len(table))
+		for _, spec := range table {
+			reply = append(reply, commandInfo(spec))
+		}
+		return ArrayValue(reply)
+	}
+	switch strings.ToLower(args[0].String()) {
+	case "count":
+		return IntegerValue(int64(len(table)))
+	case "info":
+		reply := make([]Value, 0, len(args)-1)
+		for _, arg := range args[1:] {
+			if spec, ok := table[strings.ToLower(arg.String())]; ok {
+				reply = append(reply, commandInfo(spec))
+			} else {
+				reply = append(reply, NullValue())
+			}
+		}
+		return ArrayValue(reply)
+	default:
+		return ErrorValue(fmt.Sprintf("ERR unknown COMMAND subcommand '%s'", args[0].String()))
+	}
+}
+
+// commandInfo renders one CommandSpec the way Redis's own COMMAND output
+// does: name, arity, and a flags array.
+func commandInfo(spec *CommandSpec) Value {
+	var flags []Value
+	if spec.Flags&CmdWrite != 0 {
+		flags = append(flags, SimpleStringValue("write"))
+	}
+	if spec.Flags&CmdReadOnly != 0 {
+		flags = append(flags, SimpleStringValue("readonly"))
+	}
+	if spec.Flags&CmdAdmin != 0 {
+		flags = append(flags, SimpleStringValue("admin"))
+	}
+	return ArrayValue([]Value{
+		BulkStringValue(spec.Name),
+		IntegerValue(int64(spec.Arity)),
+		ArrayValue(flags),
+	})
+}
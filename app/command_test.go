@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+)
+
+func newTestServer(t *testing.T) *Server {
+	server := &Server{
+		storage: NewStorage(),
+		rdb:     NewRDB(t.TempDir(), "dump.rdb"),
+		repl:    NewReplication(),
+		pubsub:  NewPubSub(),
+	}
+	server.commands = newCommandTable(server)
+	return server
+}
+
+func TestCommandTableArityAndLookup(t *testing.T) {
+	server := newTestServer(t)
+
+	spec, ok := server.commands["set"]
+	if !ok {
+		t.Fatalf("expected 'set' to be registered")
+	}
+	if !spec.checkArity([]Value{BulkStringValue("k"), BulkStringValue("v")}) {
+		t.Errorf("expected SET key value to satisfy arity")
+	}
+	if spec.checkArity([]Value{BulkStringValue("k")}) {
+		t.Errorf("expected SET key (missing value) to fail arity")
+	}
+
+	if _, ok := server.commands["subscribe"]; ok {
+		t.Errorf("expected 'subscribe' to stay out of the registry")
+	}
+}
+
+func TestMultiExecQueuesAndRuns(t *testing.T) {
+	server := newTestServer(t)
+	client := NewClient(nil)
+
+	if reply := handleMulti(client, nil); reply.String() != "OK" {
+		t.Fatalf("expected MULTI to reply OK, got %v", reply)
+	}
+	if !client.multi.active {
+		t.Fatalf("expected client to be in the MULTI state")
+	}
+
+	client.multi.queue = append(client.multi.queue, queuedCommand{
+		name: "set",
+		args: []Value{BulkStringValue("foo"), BulkStringValue("bar")},
+		full: ArrayValue([]Value{BulkStringValue("set"), BulkStringValue("foo"), BulkStringValue("bar")}),
+	})
+
+	reply := handleExec(client, server)
+	array := reply.Array()
+	if len(array) != 1 || array[0].String() != "OK" {
+		t.Fatalf("expected EXEC to return [OK], got %v", reply)
+	}
+	if v, found := server.storage.Get("foo"); !found || v != "bar" {
+		t.Errorf("expected foo=bar after EXEC, got %q found=%v", v, found)
+	}
+	if client.multi.active {
+		t.Errorf("expected MULTI state to be cleared after EXEC")
+	}
+}
+
+func TestExecAbortsOnWatchedKeyChange(t *testing.T) {
+	server := newTestServer(t)
+	client := NewClient(nil)
+
+	server.storage.Set("watched", "before")
+	handleWatch(client, server.storage, []Value{BulkStringValue("watched")})
+	handleMulti(client, nil)
+	client.multi.queue = append(client.multi.queue, queuedCommand{
+		name: "get",
+		args: []Value{BulkStringValue("watched")},
+		full: ArrayValue([]Value{BulkStringValue("get"), BulkStringValue("watched")}),
+	})
+
+	server.storage.Set("watched", "after")
+
+	reply := handleExec(client, server)
+	if !reply.IsNull() {
+		t.Fatalf("expected EXEC to abort with a null reply, got %v", reply)
+	}
+	if reply.typ != Array {
+		t.Fatalf("expected EXEC to abort with a null array (not a null bulk string), got type %q", byte(reply.typ))
+	}
+	var buf bytes.Buffer
+	reply.Encode(&buf, 2)
+	if buf.String() != "*-1\r\n" {
+		t.Errorf("expected RESP2 wire encoding '*-1\\r\\n', got %q", buf.String())
+	}
+}
+
+// TestExecSerializesAgainstOrdinaryWrites checks that execMu stays held for
+// EXEC's whole queued batch, not just while comparing watched versions: a
+// concurrent attempt to acquire it (as handleConnection now does around
+// every ordinary write command) must block until the batch finishes, or a
+// plain SET from another connection could land in the middle of someone
+// else's transaction.
+func TestExecSerializesAgainstOrdinaryWrites(t *testing.T) {
+	server := newTestServer(t)
+	client := NewClient(nil)
+
+	inHandler := make(chan struct{})
+	proceed := make(chan struct{})
+	server.commands["blockforever"] = &CommandSpec{
+		Name: "blockforever", Arity: 1, Flags: CmdWrite,
+		Handler: func(c *Client, args []Value) Value {
+			close(inHandler)
+			<-proceed
+			return SimpleStringValue("OK")
+		},
+	}
+
+	handleMulti(client, nil)
+	client.multi.queue = []queuedCommand{{
+		name: "blockforever",
+		full: ArrayValue([]Value{BulkStringValue("blockforever")}),
+	}}
+
+	execDone := make(chan struct{})
+	go func() {
+		handleExec(client, server)
+		close(execDone)
+	}()
+	<-inHandler
+
+	if server.execMu.TryLock() {
+		server.execMu.Unlock()
+		t.Fatalf("expected execMu to be held while EXEC's batch is still running")
+	}
+
+	close(proceed)
+	<-execDone
+
+	if !server.execMu.TryLock() {
+		t.Fatalf("expected execMu to be released once EXEC finished")
+	}
+	server.execMu.Unlock()
+}
+
+func TestExecAbortsOnInvalidQueuedCommand(t *testing.T) {
+	client := NewClient(nil)
+	server := newTestServer(t)
+
+	handleMulti(client, nil)
+	client.multi.dirty = true
+
+	reply := handleExec(client, server)
+	if !reply.IsError() {
+		t.Fatalf("expected EXECABORT error, got %v", reply)
+	}
+}
+
+func TestCommandIntrospection(t *testing.T) {
+	server := newTestServer(t)
+
+	reply := handleCommandIntrospect(server.commands, []Value{BulkStringValue("count")})
+	if reply.typ != Integer || string(reply.bytes) != strconv.Itoa(len(server.commands)) {
+		t.Fatalf("expected COMMAND COUNT to equal %d, got %v", len(server.commands), reply)
+	}
+
+	reply = handleCommandIntrospect(server.commands, []Value{BulkStringValue("info"), BulkStringValue("set"), BulkStringValue("bogus")})
+	array := reply.Array()
+	if len(array) != 2 {
+		t.Fatalf("expected 2 entries, got %v", array)
+	}
+	if !array[1].IsNull() {
+		t.Errorf("expected info for an unknown command to be null, got %v", array[1])
+	}
+}
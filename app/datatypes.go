@@ -0,0 +1,421 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+)
+
+// List commands. Backed by container/list, so push/pop at either end is
+// O(1) and LRANGE is the only operation that needs a full walk.
+
+func (s *Storage) LPush(key string, values ...string) (int, error) {
+	sh := s.shardFor(key)
+	sh.mu.Lock()
+	v, ok := sh.data[key]
+	if ok && v.IsExpired() {
+		ok = false
+	}
+	if !ok {
+		v = ValueWithExpiry{typ: ListVal, list: list.New()}
+	} else if v.typ != ListVal {
+		sh.mu.Unlock()
+		return 0, ErrWrongType
+	}
+	for _, value := range values {
+		v.list.PushFront(value)
+	}
+	sh.data[key] = v
+	n := v.list.Len()
+	sh.mu.Unlock()
+	s.markDirty(key, "lpush")
+	return n, nil
+}
+
+func (s *Storage) RPush(key string, values ...string) (int, error) {
+	sh := s.shardFor(key)
+	sh.mu.Lock()
+	v, ok := sh.data[key]
+	if ok && v.IsExpired() {
+		ok = false
+	}
+	if !ok {
+		v = ValueWithExpiry{typ: ListVal, list: list.New()}
+	} else if v.typ != ListVal {
+		sh.mu.Unlock()
+		return 0, ErrWrongType
+	}
+	for _, value := range values {
+		v.list.PushBack(value)
+	}
+	sh.data[key] = v
+	n := v.list.Len()
+	sh.mu.Unlock()
+	s.markDirty(key, "rpush")
+	return n, nil
+}
+
+// LPop removes and returns the first element of key, if it exists.
+func (s *Storage) LPop(key string) (string, bool, error) {
+	return s.listPop(key, true, "lpop")
+}
+
+// RPop removes and returns the last element of key, if it exists.
+func (s *Storage) RPop(key string) (string, bool, error) {
+	return s.listPop(key, false, "rpop")
+}
+
+func (s *Storage) listPop(key string, front bool, event string) (string, bool, error) {
+	sh := s.shardFor(key)
+	sh.mu.Lock()
+	v, ok := sh.data[key]
+	if ok && v.IsExpired() {
+		ok = false
+	}
+	if !ok {
+		sh.mu.Unlock()
+		return "", false, nil
+	}
+	if v.typ != ListVal {
+		sh.mu.Unlock()
+		return "", false, ErrWrongType
+	}
+	var elem *list.Element
+	if front {
+		elem = v.list.Front()
+	} else {
+		elem = v.list.Back()
+	}
+	if elem == nil {
+		sh.mu.Unlock()
+		return "", false, nil
+	}
+	value := v.list.Remove(elem).(string)
+	if v.list.Len() == 0 {
+		delete(sh.data, key)
+	}
+	sh.mu.Unlock()
+	s.markDirty(key, event)
+	return value, true, nil
+}
+
+// LRange returns the elements of key between the (possibly negative) start
+// and stop indexes, inclusive.
+func (s *Storage) LRange(key string, start, stop int) ([]string, error) {
+	sh, v, ok := s.getForRead(key)
+	if !ok {
+		return nil, nil
+	}
+	defer sh.mu.RUnlock()
+	if v.typ != ListVal {
+		return nil, ErrWrongType
+	}
+	elements := make([]string, 0, v.list.Len())
+	for e := v.list.Front(); e != nil; e = e.Next() {
+		elements = append(elements, e.Value.(string))
+	}
+	from, to, inRange := clampRange(start, stop, len(elements))
+	if !inRange {
+		return nil, nil
+	}
+	return elements[from : to+1], nil
+}
+
+// LLen reports the length of the list at key, 0 if it doesn't exist.
+func (s *Storage) LLen(key string) (int, error) {
+	sh, v, ok := s.getForRead(key)
+	if !ok {
+		return 0, nil
+	}
+	defer sh.mu.RUnlock()
+	if v.typ != ListVal {
+		return 0, ErrWrongType
+	}
+	return v.list.Len(), nil
+}
+
+// Hash commands, backed by a plain map[string]string per key.
+
+// HSet sets each field to its value, reporting how many fields were newly
+// created (as opposed to overwritten).
+func (s *Storage) HSet(key string, fields map[string]string) (int, error) {
+	sh := s.shardFor(key)
+	sh.mu.Lock()
+	v, ok := sh.data[key]
+	if ok && v.IsExpired() {
+		ok = false
+	}
+	if !ok {
+		v = ValueWithExpiry{typ: HashVal, hash: make(map[string]string)}
+	} else if v.typ != HashVal {
+		sh.mu.Unlock()
+		return 0, ErrWrongType
+	}
+	created := 0
+	for field, value := range fields {
+		if _, exists := v.hash[field]; !exists {
+			created++
+		}
+		v.hash[field] = value
+	}
+	sh.data[key] = v
+	sh.mu.Unlock()
+	s.markDirty(key, "hset")
+	return created, nil
+}
+
+func (s *Storage) HGet(key, field string) (string, bool, error) {
+	sh, v, ok := s.getForRead(key)
+	if !ok {
+		return "", false, nil
+	}
+	defer sh.mu.RUnlock()
+	if v.typ != HashVal {
+		return "", false, ErrWrongType
+	}
+	value, ok := v.hash[field]
+	return value, ok, nil
+}
+
+// HDel removes the given fields, reporting how many were present.
+func (s *Storage) HDel(key string, fields ...string) (int, error) {
+	sh := s.shardFor(key)
+	sh.mu.Lock()
+	v, ok := sh.data[key]
+	if ok && v.IsExpired() {
+		ok = false
+	}
+	if !ok {
+		sh.mu.Unlock()
+		return 0, nil
+	}
+	if v.typ != HashVal {
+		sh.mu.Unlock()
+		return 0, ErrWrongType
+	}
+	removed := 0
+	for _, field := range fields {
+		if _, exists := v.hash[field]; exists {
+			delete(v.hash, field)
+			removed++
+		}
+	}
+	if len(v.hash) == 0 {
+		delete(sh.data, key)
+	}
+	sh.mu.Unlock()
+	if removed > 0 {
+		s.markDirty(key, "hdel")
+	}
+	return removed, nil
+}
+
+// HGetAll returns a copy of every field/value pair in the hash at key.
+func (s *Storage) HGetAll(key string) (map[string]string, error) {
+	sh, v, ok := s.getForRead(key)
+	if !ok {
+		return nil, nil
+	}
+	defer sh.mu.RUnlock()
+	if v.typ != HashVal {
+		return nil, ErrWrongType
+	}
+	out := make(map[string]string, len(v.hash))
+	for field, value := range v.hash {
+		out[field] = value
+	}
+	return out, nil
+}
+
+// HIncrBy adds delta to field's integer value (0 if absent) and returns the
+// result, failing if the existing value isn't an integer.
+func (s *Storage) HIncrBy(key, field string, delta int64) (int64, error) {
+	sh := s.shardFor(key)
+	sh.mu.Lock()
+	v, ok := sh.data[key]
+	if ok && v.IsExpired() {
+		ok = false
+	}
+	if !ok {
+		v = ValueWithExpiry{typ: HashVal, hash: make(map[string]string)}
+	} else if v.typ != HashVal {
+		sh.mu.Unlock()
+		return 0, ErrWrongType
+	}
+	current := int64(0)
+	if raw, exists := v.hash[field]; exists {
+		parsed, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			sh.mu.Unlock()
+			return 0, fmt.Errorf("ERR hash value is not an integer")
+		}
+		current = parsed
+	}
+	result := current + delta
+	v.hash[field] = strconv.FormatInt(result, 10)
+	sh.data[key] = v
+	sh.mu.Unlock()
+	s.markDirty(key, "hincrby")
+	return result, nil
+}
+
+// Set commands, backed by a plain map[string]struct{} per key.
+
+// SAdd adds members to the set at key, reporting how many were new.
+func (s *Storage) SAdd(key string, members ...string) (int, error) {
+	sh := s.shardFor(key)
+	sh.mu.Lock()
+	v, ok := sh.data[key]
+	if ok && v.IsExpired() {
+		ok = false
+	}
+	if !ok {
+		v = ValueWithExpiry{typ: SetVal, set: make(map[string]struct{})}
+	} else if v.typ != SetVal {
+		sh.mu.Unlock()
+		return 0, ErrWrongType
+	}
+	added := 0
+	for _, member := range members {
+		if _, exists := v.set[member]; !exists {
+			v.set[member] = struct{}{}
+			added++
+		}
+	}
+	sh.data[key] = v
+	sh.mu.Unlock()
+	if added > 0 {
+		s.markDirty(key, "sadd")
+	}
+	return added, nil
+}
+
+// SRem removes members from the set at key, reporting how many were present.
+func (s *Storage) SRem(key string, members ...string) (int, error) {
+	sh := s.shardFor(key)
+	sh.mu.Lock()
+	v, ok := sh.data[key]
+	if ok && v.IsExpired() {
+		ok = false
+	}
+	if !ok {
+		sh.mu.Unlock()
+		return 0, nil
+	}
+	if v.typ != SetVal {
+		sh.mu.Unlock()
+		return 0, ErrWrongType
+	}
+	removed := 0
+	for _, member := range members {
+		if _, exists := v.set[member]; exists {
+			delete(v.set, member)
+			removed++
+		}
+	}
+	if len(v.set) == 0 {
+		delete(sh.data, key)
+	}
+	sh.mu.Unlock()
+	if removed > 0 {
+		s.markDirty(key, "srem")
+	}
+	return removed, nil
+}
+
+// SMembers returns every member of the set at key.
+func (s *Storage) SMembers(key string) ([]string, error) {
+	sh, v, ok := s.getForRead(key)
+	if !ok {
+		return nil, nil
+	}
+	defer sh.mu.RUnlock()
+	if v.typ != SetVal {
+		return nil, ErrWrongType
+	}
+	members := make([]string, 0, len(v.set))
+	for member := range v.set {
+		members = append(members, member)
+	}
+	return members, nil
+}
+
+// SInter returns the members common to every set named in keys.
+func (s *Storage) SInter(keys ...string) ([]string, error) {
+	sets, err := s.fetchSets(keys)
+	if err != nil {
+		return nil, err
+	}
+	if len(sets) == 0 {
+		return nil, nil
+	}
+	var result []string
+	for member := range sets[0] {
+		inAll := true
+		for _, other := range sets[1:] {
+			if _, ok := other[member]; !ok {
+				inAll = false
+				break
+			}
+		}
+		if inAll {
+			result = append(result, member)
+		}
+	}
+	return result, nil
+}
+
+// SUnion returns the members appearing in any set named in keys.
+func (s *Storage) SUnion(keys ...string) ([]string, error) {
+	sets, err := s.fetchSets(keys)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]struct{})
+	for _, set := range sets {
+		for member := range set {
+			seen[member] = struct{}{}
+		}
+	}
+	result := make([]string, 0, len(seen))
+	for member := range seen {
+		result = append(result, member)
+	}
+	return result, nil
+}
+
+// fetchSets reads each key's set independently (never holding more than one
+// shard lock at a time) and reports ErrWrongType if any key holds a
+// non-set value. Missing keys are treated as empty sets. Each set is copied
+// while its shard is still locked, so the caller can read it afterward
+// without racing a concurrent writer.
+func (s *Storage) fetchSets(keys []string) ([]map[string]struct{}, error) {
+	sets := make([]map[string]struct{}, 0, len(keys))
+	for _, key := range keys {
+		sh, v, ok := s.getForRead(key)
+		if !ok {
+			sets = append(sets, map[string]struct{}{})
+			continue
+		}
+		if v.typ != SetVal {
+			sh.mu.RUnlock()
+			return nil, ErrWrongType
+		}
+		set := make(map[string]struct{}, len(v.set))
+		for member := range v.set {
+			set[member] = struct{}{}
+		}
+		sh.mu.RUnlock()
+		sets = append(sets, set)
+	}
+	return sets, nil
+}
+
+// markDirty bumps the dirty counter and fires a keyspace notification for a
+// typed-collection write, mirroring what Set/Del already do for strings.
+func (s *Storage) markDirty(key, event string) {
+	atomic.AddInt64(&s.dirty, 1)
+	s.bumpVersion(key)
+	s.notify(event, key)
+}
@@ -0,0 +1,92 @@
+package main
+
+import "testing"
+
+func TestListPushPopRange(t *testing.T) {
+	storage := NewStorage()
+	storage.RPush("mylist", "a", "b", "c")
+	storage.LPush("mylist", "z")
+
+	if n, _ := storage.LLen("mylist"); n != 4 {
+		t.Fatalf("expected length 4, got %d", n)
+	}
+	elements, err := storage.LRange("mylist", 0, -1)
+	if err != nil {
+		t.Fatalf("LRange failed: %s", err)
+	}
+	want := []string{"z", "a", "b", "c"}
+	for i, w := range want {
+		if elements[i] != w {
+			t.Errorf("expected %v, got %v", want, elements)
+			break
+		}
+	}
+
+	value, found, err := storage.LPop("mylist")
+	if err != nil || !found || value != "z" {
+		t.Errorf("expected LPop to return 'z', got %q found=%v err=%v", value, found, err)
+	}
+	value, found, err = storage.RPop("mylist")
+	if err != nil || !found || value != "c" {
+		t.Errorf("expected RPop to return 'c', got %q found=%v err=%v", value, found, err)
+	}
+}
+
+func TestListWrongType(t *testing.T) {
+	storage := NewStorage()
+	storage.Set("str", "value")
+
+	if _, err := storage.LLen("str"); err != ErrWrongType {
+		t.Errorf("expected ErrWrongType, got %v", err)
+	}
+}
+
+func TestHashSetGetDelIncr(t *testing.T) {
+	storage := NewStorage()
+	created, err := storage.HSet("user", map[string]string{"name": "bob", "age": "30"})
+	if err != nil || created != 2 {
+		t.Fatalf("expected 2 new fields, got %d err=%v", created, err)
+	}
+
+	if v, found, _ := storage.HGet("user", "name"); !found || v != "bob" {
+		t.Errorf("expected name=bob, got %q found=%v", v, found)
+	}
+
+	result, err := storage.HIncrBy("user", "age", 1)
+	if err != nil || result != 31 {
+		t.Errorf("expected age=31, got %d err=%v", result, err)
+	}
+
+	removed, err := storage.HDel("user", "name")
+	if err != nil || removed != 1 {
+		t.Errorf("expected 1 field removed, got %d err=%v", removed, err)
+	}
+	if _, found, _ := storage.HGet("user", "name"); found {
+		t.Errorf("expected name to be gone after HDel")
+	}
+}
+
+func TestSetAddRemInterUnion(t *testing.T) {
+	storage := NewStorage()
+	storage.SAdd("a", "1", "2", "3")
+	storage.SAdd("b", "2", "3", "4")
+
+	inter, err := storage.SInter("a", "b")
+	if err != nil || len(inter) != 2 {
+		t.Fatalf("expected 2 common members, got %v err=%v", inter, err)
+	}
+
+	union, err := storage.SUnion("a", "b")
+	if err != nil || len(union) != 4 {
+		t.Fatalf("expected 4 union members, got %v err=%v", union, err)
+	}
+
+	removed, err := storage.SRem("a", "1")
+	if err != nil || removed != 1 {
+		t.Errorf("expected 1 member removed, got %d err=%v", removed, err)
+	}
+	members, _ := storage.SMembers("a")
+	if len(members) != 2 {
+		t.Errorf("expected 2 members left in 'a', got %v", members)
+	}
+}
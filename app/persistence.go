@@ -0,0 +1,628 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Persistence is anything that can dump the current dataset to durable
+// storage and reload it on startup. RDB implements this as a point-in-time
+// binary snapshot; AOF implements it as a compacting rewrite of its command
+// log (Save) and a full replay of that log (Load).
+type Persistence interface {
+	Save(storage *Storage) error
+	Load(storage *Storage) error
+}
+
+// SavePoint mirrors a single `save <seconds> <changes>` line from a Redis
+// config: a BGSAVE is due once at least Seconds have elapsed since the last
+// save AND at least Changes writes have happened since then.
+type SavePoint struct {
+	Seconds int
+	Changes int
+}
+
+const (
+	rdbMagic            = "RODIS"
+	rdbVersion     byte = 1
+	rdbTypeString  byte = 0
+	rdbTypeList    byte = 1
+	rdbTypeHash    byte = 2
+	rdbTypeSet     byte = 3
+	rdbTypeZSet    byte = 4
+	rdbEOF         byte = 0xFF
+	rdbChecksumLen      = 8
+)
+
+// RDB is a point-in-time binary snapshotter: magic header, version, then one
+// record per key (type, key bulk, value bulk, optional PEXPIREAT millis),
+// an EOF marker and a CRC64 trailer over everything before it.
+type RDB struct {
+	dir        string
+	dbfilename string
+	lastSave   int64 // unix seconds, atomic
+}
+
+func NewRDB(dir, dbfilename string) *RDB {
+	return &RDB{dir: dir, dbfilename: dbfilename}
+}
+
+func (r *RDB) path() string {
+	return filepath.Join(r.dir, r.dbfilename)
+}
+
+// LastSave returns the unix timestamp of the last successful Save, or 0 if
+// none has happened yet this run (the LASTSAVE command).
+func (r *RDB) LastSave() int64 {
+	return atomic.LoadInt64(&r.lastSave)
+}
+
+func (r *RDB) Save(storage *Storage) error {
+	buf := encodeRDB(storage)
+
+	if err := os.MkdirAll(r.dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(r.dir, "rdb-*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), r.path()); err != nil {
+		return err
+	}
+	atomic.StoreInt64(&r.lastSave, time.Now().Unix())
+	return nil
+}
+
+func (r *RDB) Load(storage *Storage) error {
+	data, err := os.ReadFile(r.path())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return decodeRDB(data, storage)
+}
+
+// encodeRDB serializes the entire live dataset into the on-disk/wire RDB
+// format: magic header, version, one record per key, an EOF marker and a
+// CRC64 trailer over everything before it. It is shared by RDB.Save (which
+// writes the result to disk) and the replication full-resync path (which
+// streams it straight to a replica).
+func encodeRDB(storage *Storage) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(rdbMagic)
+	buf.WriteByte(rdbVersion)
+	for key, v := range storage.Snapshot() {
+		writeRDBValue(&buf, key, v)
+	}
+	buf.WriteByte(rdbEOF)
+	checksum := crc64.Checksum(buf.Bytes(), crc64.MakeTable(crc64.ISO))
+	binary.Write(&buf, binary.LittleEndian, checksum)
+	return buf.Bytes()
+}
+
+// writeRDBValue appends one record for key/v: a type byte, the key, a
+// type-specific body, and the optional expiry trailer shared by every type.
+func writeRDBValue(buf *bytes.Buffer, key string, v ValueWithExpiry) {
+	switch v.typ {
+	case StringVal:
+		buf.WriteByte(rdbTypeString)
+		writeRDBBulk(buf, []byte(key))
+		writeRDBBulk(buf, []byte(v.str))
+	case ListVal:
+		buf.WriteByte(rdbTypeList)
+		writeRDBBulk(buf, []byte(key))
+		binary.Write(buf, binary.LittleEndian, uint32(v.list.Len()))
+		for e := v.list.Front(); e != nil; e = e.Next() {
+			writeRDBBulk(buf, []byte(e.Value.(string)))
+		}
+	case HashVal:
+		buf.WriteByte(rdbTypeHash)
+		writeRDBBulk(buf, []byte(key))
+		binary.Write(buf, binary.LittleEndian, uint32(len(v.hash)))
+		for field, value := range v.hash {
+			writeRDBBulk(buf, []byte(field))
+			writeRDBBulk(buf, []byte(value))
+		}
+	case SetVal:
+		buf.WriteByte(rdbTypeSet)
+		writeRDBBulk(buf, []byte(key))
+		binary.Write(buf, binary.LittleEndian, uint32(len(v.set)))
+		for member := range v.set {
+			writeRDBBulk(buf, []byte(member))
+		}
+	case ZSetVal:
+		buf.WriteByte(rdbTypeZSet)
+		writeRDBBulk(buf, []byte(key))
+		binary.Write(buf, binary.LittleEndian, uint32(v.zset.Len()))
+		for _, member := range v.zset.Range(0, -1) {
+			score, _ := v.zset.Score(member)
+			writeRDBBulk(buf, []byte(member))
+			binary.Write(buf, binary.LittleEndian, score)
+		}
+	}
+	if v.expiresAt.IsZero() {
+		buf.WriteByte(0)
+	} else {
+		buf.WriteByte(1)
+		binary.Write(buf, binary.LittleEndian, v.expiresAt.UnixMilli())
+	}
+}
+
+// decodeRDB is the counterpart of encodeRDB, restoring every record it finds
+// into storage. It is shared by RDB.Load (reading from disk) and a
+// replica's full-resync path (reading the bulk string a PSYNC reply sends).
+func decodeRDB(data []byte, storage *Storage) error {
+	if len(data) < len(rdbMagic)+1+rdbChecksumLen {
+		return fmt.Errorf("rdb: truncated file")
+	}
+	payload := data[:len(data)-rdbChecksumLen]
+	wantChecksum := binary.LittleEndian.Uint64(data[len(data)-rdbChecksumLen:])
+	if crc64.Checksum(payload, crc64.MakeTable(crc64.ISO)) != wantChecksum {
+		return fmt.Errorf("rdb: checksum mismatch")
+	}
+
+	reader := bytes.NewReader(payload)
+	magic := make([]byte, len(rdbMagic))
+	if _, err := io.ReadFull(reader, magic); err != nil {
+		return err
+	}
+	if string(magic) != rdbMagic {
+		return fmt.Errorf("rdb: bad magic %q", magic)
+	}
+	if _, err := reader.ReadByte(); err != nil { // version, unused for now
+		return err
+	}
+	for {
+		typ, err := reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		if typ == rdbEOF {
+			return nil
+		}
+		key, err := readRDBBulk(reader)
+		if err != nil {
+			return err
+		}
+		v, err := readRDBValue(reader, typ)
+		if err != nil {
+			return err
+		}
+		hasExpiry, err := reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		if hasExpiry == 1 {
+			var millis int64
+			if err := binary.Read(reader, binary.LittleEndian, &millis); err != nil {
+				return err
+			}
+			v.expiresAt = time.UnixMilli(millis)
+		}
+		storage.Restore(string(key), v)
+	}
+}
+
+// readRDBValue reads one record's type-specific body, the counterpart of
+// writeRDBValue's per-type switch.
+func readRDBValue(r *bytes.Reader, typ byte) (ValueWithExpiry, error) {
+	switch typ {
+	case rdbTypeString:
+		value, err := readRDBBulk(r)
+		if err != nil {
+			return ValueWithExpiry{}, err
+		}
+		return ValueWithExpiry{typ: StringVal, str: string(value)}, nil
+	case rdbTypeList:
+		var n uint32
+		if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+			return ValueWithExpiry{}, err
+		}
+		l := list.New()
+		for i := uint32(0); i < n; i++ {
+			elem, err := readRDBBulk(r)
+			if err != nil {
+				return ValueWithExpiry{}, err
+			}
+			l.PushBack(string(elem))
+		}
+		return ValueWithExpiry{typ: ListVal, list: l}, nil
+	case rdbTypeHash:
+		var n uint32
+		if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+			return ValueWithExpiry{}, err
+		}
+		hash := make(map[string]string, n)
+		for i := uint32(0); i < n; i++ {
+			field, err := readRDBBulk(r)
+			if err != nil {
+				return ValueWithExpiry{}, err
+			}
+			value, err := readRDBBulk(r)
+			if err != nil {
+				return ValueWithExpiry{}, err
+			}
+			hash[string(field)] = string(value)
+		}
+		return ValueWithExpiry{typ: HashVal, hash: hash}, nil
+	case rdbTypeSet:
+		var n uint32
+		if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+			return ValueWithExpiry{}, err
+		}
+		set := make(map[string]struct{}, n)
+		for i := uint32(0); i < n; i++ {
+			member, err := readRDBBulk(r)
+			if err != nil {
+				return ValueWithExpiry{}, err
+			}
+			set[string(member)] = struct{}{}
+		}
+		return ValueWithExpiry{typ: SetVal, set: set}, nil
+	case rdbTypeZSet:
+		var n uint32
+		if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+			return ValueWithExpiry{}, err
+		}
+		zset := newZSet()
+		for i := uint32(0); i < n; i++ {
+			member, err := readRDBBulk(r)
+			if err != nil {
+				return ValueWithExpiry{}, err
+			}
+			var score float64
+			if err := binary.Read(r, binary.LittleEndian, &score); err != nil {
+				return ValueWithExpiry{}, err
+			}
+			zset.Add(string(member), score)
+		}
+		return ValueWithExpiry{typ: ZSetVal, zset: zset}, nil
+	default:
+		return ValueWithExpiry{}, fmt.Errorf("rdb: unknown type byte %d", typ)
+	}
+}
+
+func writeRDBBulk(buf *bytes.Buffer, b []byte) {
+	binary.Write(buf, binary.LittleEndian, uint32(len(b)))
+	buf.Write(b)
+}
+
+func readRDBBulk(r *bytes.Reader) ([]byte, error) {
+	var n uint32
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return nil, err
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// RunSavePolicy blocks forever, triggering a BGSAVE whenever one of points
+// is satisfied, then resetting the dirty counter and the elapsed-time clock.
+func (r *RDB) RunSavePolicy(storage *Storage, points []SavePoint) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	since := time.Now()
+	for range ticker.C {
+		elapsed := int(time.Since(since).Seconds())
+		for _, p := range points {
+			if elapsed >= p.Seconds && storage.Dirty() >= int64(p.Changes) {
+				if err := r.Save(storage); err == nil {
+					storage.ResetDirty()
+					since = time.Now()
+				}
+				break
+			}
+		}
+	}
+}
+
+// AOFPolicy controls how aggressively AOF fsyncs after a write.
+type AOFPolicy string
+
+const (
+	AOFAlways   AOFPolicy = "always"
+	AOFEverySec AOFPolicy = "everysec"
+	AOFNo       AOFPolicy = "no"
+)
+
+// AOF is an append-only command log: every mutating command is re-serialized
+// as a RESP array and appended, fsynced according to policy. Save rewrites
+// the log compactly from the current dataset (BGREWRITEAOF); Load replays
+// every command in the log against storage (startup).
+type AOF struct {
+	mu     sync.Mutex
+	file   *os.File
+	path   string
+	policy AOFPolicy
+}
+
+func NewAOF(dir, filename string, policy AOFPolicy) (*AOF, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, filename)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	a := &AOF{file: f, path: path, policy: policy}
+	if policy == AOFEverySec {
+		go a.fsyncLoop()
+	}
+	return a, nil
+}
+
+func (a *AOF) fsyncLoop() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		a.mu.Lock()
+		a.file.Sync()
+		a.mu.Unlock()
+	}
+}
+
+// Append re-serializes cmd (the full command array, e.g. ["set","k","v"])
+// and writes it to the log, fsyncing immediately under the "always" policy.
+func (a *AOF) Append(cmd Value) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := cmd.Encode(a.file, 2); err != nil {
+		return err
+	}
+	if a.policy == AOFAlways {
+		return a.file.Sync()
+	}
+	return nil
+}
+
+// Load replays every command in the log against storage. It is meant to run
+// once at startup, before the log is open for appending new commands.
+func (a *AOF) Load(storage *Storage) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(a.file)
+	for {
+		value, err := DecodeRESP(reader)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		args := value.Array()
+		if len(args) == 0 {
+			continue
+		}
+		applyWriteCommand(storage, args[0].String(), args[1:])
+	}
+	_, err := a.file.Seek(0, io.SeekEnd)
+	return err
+}
+
+// Save rewrites the log from scratch as the smallest set of SET commands
+// that reproduce the current dataset (BGREWRITEAOF).
+func (a *AOF) Save(storage *Storage) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	tmp, err := os.CreateTemp(filepath.Dir(a.path), "aof-rewrite-*.tmp")
+	if err != nil {
+		return err
+	}
+	for key, v := range storage.Snapshot() {
+		for _, cmd := range rewriteCommandsFor(key, v) {
+			entry := ArrayValue(cmd)
+			if err := entry.Encode(tmp, 2); err != nil {
+				tmp.Close()
+				os.Remove(tmp.Name())
+				return err
+			}
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), a.path); err != nil {
+		return err
+	}
+
+	a.file.Close()
+	f, err := os.OpenFile(a.path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	a.file = f
+	return nil
+}
+
+// rewriteCommandsFor returns the command(s) that recreate key/v from
+// scratch, for AOF.Save's compacting rewrite: one type-appropriate command
+// to populate the value, plus a trailing PEXPIRE if it carries an expiry.
+func rewriteCommandsFor(key string, v ValueWithExpiry) [][]Value {
+	var cmds [][]Value
+	switch v.typ {
+	case StringVal:
+		cmds = append(cmds, []Value{BulkStringValue("set"), BulkStringValue(key), BulkStringValue(v.str)})
+	case ListVal:
+		cmd := []Value{BulkStringValue("rpush"), BulkStringValue(key)}
+		for e := v.list.Front(); e != nil; e = e.Next() {
+			cmd = append(cmd, BulkStringValue(e.Value.(string)))
+		}
+		cmds = append(cmds, cmd)
+	case HashVal:
+		cmd := []Value{BulkStringValue("hset"), BulkStringValue(key)}
+		for field, value := range v.hash {
+			cmd = append(cmd, BulkStringValue(field), BulkStringValue(value))
+		}
+		cmds = append(cmds, cmd)
+	case SetVal:
+		cmd := []Value{BulkStringValue("sadd"), BulkStringValue(key)}
+		for member := range v.set {
+			cmd = append(cmd, BulkStringValue(member))
+		}
+		cmds = append(cmds, cmd)
+	case ZSetVal:
+		cmd := []Value{BulkStringValue("zadd"), BulkStringValue(key)}
+		for _, member := range v.zset.Range(0, -1) {
+			score, _ := v.zset.Score(member)
+			cmd = append(cmd, BulkStringValue(strconv.FormatFloat(score, 'g', -1, 64)), BulkStringValue(member))
+		}
+		cmds = append(cmds, cmd)
+	}
+	if !v.expiresAt.IsZero() {
+		millis := strconv.FormatInt(time.Until(v.expiresAt).Milliseconds(), 10)
+		cmds = append(cmds, []Value{BulkStringValue("pexpire"), BulkStringValue(key), BulkStringValue(millis)})
+	}
+	return cmds
+}
+
+// applyWriteCommand applies a previously-logged mutating command to storage.
+// It is the replay counterpart of handleConnection's command switch, used by
+// AOF.Load: malformed entries are skipped rather than erroring, since a
+// well-formed log should never contain one.
+func applyWriteCommand(storage *Storage, command string, args []Value) {
+	switch command {
+	case "set":
+		if len(args) < 2 {
+			return
+		}
+		if len(args) > 2 && args[2].String() == "px" {
+			expiry, err := strconv.Atoi(args[3].String())
+			if err != nil {
+				return
+			}
+			storage.SetWithExpiry(args[0].String(), args[1].String(), time.Duration(expiry)*time.Millisecond)
+			return
+		}
+		storage.Set(args[0].String(), args[1].String())
+	case "del":
+		for _, arg := range args {
+			storage.Del(arg.String())
+		}
+	case "pexpire":
+		if len(args) < 2 {
+			return
+		}
+		millis, err := strconv.Atoi(args[1].String())
+		if err != nil {
+			return
+		}
+		if v, found := storage.get(args[0].String()); found {
+			v.expiresAt = time.Now().Add(time.Duration(millis) * time.Millisecond)
+			storage.Restore(args[0].String(), v)
+		}
+	case "lpush":
+		if len(args) < 2 {
+			return
+		}
+		storage.LPush(args[0].String(), stringArgs(args[1:])...)
+	case "rpush":
+		if len(args) < 2 {
+			return
+		}
+		storage.RPush(args[0].String(), stringArgs(args[1:])...)
+	case "lpop":
+		if len(args) < 1 {
+			return
+		}
+		storage.LPop(args[0].String())
+	case "rpop":
+		if len(args) < 1 {
+			return
+		}
+		storage.RPop(args[0].String())
+	case "hset":
+		if len(args) < 3 || len(args)%2 != 1 {
+			return
+		}
+		fields := make(map[string]string, (len(args)-1)/2)
+		for i := 1; i < len(args); i += 2 {
+			fields[args[i].String()] = args[i+1].String()
+		}
+		storage.HSet(args[0].String(), fields)
+	case "hdel":
+		if len(args) < 2 {
+			return
+		}
+		storage.HDel(args[0].String(), stringArgs(args[1:])...)
+	case "hincrby":
+		if len(args) < 3 {
+			return
+		}
+		delta, err := strconv.ParseInt(args[2].String(), 10, 64)
+		if err != nil {
+			return
+		}
+		storage.HIncrBy(args[0].String(), args[1].String(), delta)
+	case "sadd":
+		if len(args) < 2 {
+			return
+		}
+		storage.SAdd(args[0].String(), stringArgs(args[1:])...)
+	case "srem":
+		if len(args) < 2 {
+			return
+		}
+		storage.SRem(args[0].String(), stringArgs(args[1:])...)
+	case "zadd":
+		if len(args) < 3 || len(args)%2 != 1 {
+			return
+		}
+		members := make(map[string]float64, (len(args)-1)/2)
+		for i := 1; i < len(args); i += 2 {
+			score, err := strconv.ParseFloat(args[i].String(), 64)
+			if err != nil {
+				return
+			}
+			members[args[i+1].String()] = score
+		}
+		storage.ZAdd(args[0].String(), members)
+	case "zincrby":
+		if len(args) < 3 {
+			return
+		}
+		delta, err := strconv.ParseFloat(args[1].String(), 64)
+		if err != nil {
+			return
+		}
+		storage.ZIncrBy(args[0].String(), args[2].String(), delta)
+	}
+}
+
+func stringArgs(values []Value) []string {
+	out := make([]string, len(values))
+	for i, v := range values {
+		out[i] = v.String()
+	}
+	return out
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRDBSaveAndLoad(t *testing.T) {
+	dir := t.TempDir()
+	rdb := NewRDB(dir, "dump.rdb")
+
+	storage := NewStorage()
+	storage.Set("foo", "bar")
+	storage.SetWithExpiry("baz", "qux", time.Hour)
+
+	if err := rdb.Save(storage); err != nil {
+		t.Fatalf("Save failed: %s", err)
+	}
+	if rdb.LastSave() == 0 {
+		t.Errorf("expected LastSave to be set after a successful save")
+	}
+
+	loaded := NewStorage()
+	if err := rdb.Load(loaded); err != nil {
+		t.Fatalf("Load failed: %s", err)
+	}
+
+	if v, found := loaded.Get("foo"); !found || v != "bar" {
+		t.Errorf("expected foo=bar, got %q found=%v", v, found)
+	}
+	if v, found := loaded.Get("baz"); !found || v != "qux" {
+		t.Errorf("expected baz=qux, got %q found=%v", v, found)
+	}
+}
+
+func TestRDBSaveAndLoadRichTypes(t *testing.T) {
+	dir := t.TempDir()
+	rdb := NewRDB(dir, "dump.rdb")
+
+	storage := NewStorage()
+	storage.RPush("mylist", "a", "b")
+	storage.HSet("myhash", map[string]string{"field": "value"})
+	storage.SAdd("myset", "x", "y")
+	storage.ZAdd("myzset", map[string]float64{"m": 1.5})
+
+	if err := rdb.Save(storage); err != nil {
+		t.Fatalf("Save failed: %s", err)
+	}
+
+	loaded := NewStorage()
+	if err := rdb.Load(loaded); err != nil {
+		t.Fatalf("Load failed: %s", err)
+	}
+
+	if elements, _ := loaded.LRange("mylist", 0, -1); len(elements) != 2 {
+		t.Errorf("expected 2 list elements after reload, got %v", elements)
+	}
+	if v, found, _ := loaded.HGet("myhash", "field"); !found || v != "value" {
+		t.Errorf("expected field=value after reload, got %q found=%v", v, found)
+	}
+	if members, _ := loaded.SMembers("myset"); len(members) != 2 {
+		t.Errorf("expected 2 set members after reload, got %v", members)
+	}
+	if members, _ := loaded.ZRange("myzset", 0, -1); len(members) != 1 || members[0] != "m" {
+		t.Errorf("expected zset member 'm' after reload, got %v", members)
+	}
+}
+
+func TestAOFAppendAndLoad(t *testing.T) {
+	dir := t.TempDir()
+	aof, err := NewAOF(dir, "appendonly.aof", AOFAlways)
+	if err != nil {
+		t.Fatalf("NewAOF failed: %s", err)
+	}
+
+	aof.Append(ArrayValue([]Value{BulkStringValue("set"), BulkStringValue("foo"), BulkStringValue("bar")}))
+	aof.Append(ArrayValue([]Value{BulkStringValue("del"), BulkStringValue("foo")}))
+	aof.Append(ArrayValue([]Value{BulkStringValue("set"), BulkStringValue("answer"), BulkStringValue("42")}))
+
+	storage := NewStorage()
+	if err := aof.Load(storage); err != nil {
+		t.Fatalf("Load failed: %s", err)
+	}
+
+	if _, found := storage.Get("foo"); found {
+		t.Errorf("expected foo to have been deleted by replay")
+	}
+	if v, found := storage.Get("answer"); !found || v != "42" {
+		t.Errorf("expected answer=42, got %q found=%v", v, found)
+	}
+}
+
+func TestAOFRewriteIsReplayable(t *testing.T) {
+	dir := t.TempDir()
+	aof, err := NewAOF(dir, "appendonly.aof", AOFAlways)
+	if err != nil {
+		t.Fatalf("NewAOF failed: %s", err)
+	}
+
+	storage := NewStorage()
+	storage.Set("foo", "bar")
+
+	if err := aof.Save(storage); err != nil {
+		t.Fatalf("Save (rewrite) failed: %s", err)
+	}
+
+	loaded := NewStorage()
+	if err := aof.Load(loaded); err != nil {
+		t.Fatalf("Load after rewrite failed: %s", err)
+	}
+	if v, found := loaded.Get("foo"); !found || v != "bar" {
+		t.Errorf("expected foo=bar after rewrite+replay, got %q found=%v", v, found)
+	}
+}
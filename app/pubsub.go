@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// PubSub owns every channel and pattern subscription in the server. A
+// subscribed Client is tracked on both sides: here, for Publish to find its
+// receivers, and on the Client itself, so it knows it's in the restricted
+// subscriber mode and what to clean up on disconnect.
+type PubSub struct {
+	mu       sync.RWMutex
+	channels map[string]map[*Client]bool
+	patterns map[string]map[*Client]bool
+
+	notifyEvents atomic.Bool // notify-keyspace-events config flag
+}
+
+func NewPubSub() *PubSub {
+	return &PubSub{
+		channels: make(map[string]map[*Client]bool),
+		patterns: make(map[string]map[*Client]bool),
+	}
+}
+
+func (p *PubSub) SetNotifyKeyspaceEvents(enabled bool) {
+	p.notifyEvents.Store(enabled)
+}
+
+func (p *PubSub) NotifyKeyspaceEvents() bool {
+	return p.notifyEvents.Load()
+}
+
+// Notify implements KeyspaceNotifier: it turns a Storage write/expiration
+// into the two conventional keyspace notification channels.
+func (p *PubSub) Notify(event, key string) {
+	if !p.notifyEvents.Load() {
+		return
+	}
+	p.Publish("__keyspace@0__:"+key, event)
+	p.Publish("__keyevent@0__:"+event, key)
+}
+
+func (p *PubSub) Subscribe(c *Client, channel string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.channels[channel] == nil {
+		p.channels[channel] = make(map[*Client]bool)
+	}
+	p.channels[channel][c] = true
+	c.addChannel(channel)
+	return c.SubCount()
+}
+
+func (p *PubSub) Unsubscribe(c *Client, channel string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if subs, ok := p.channels[channel]; ok {
+		delete(subs, c)
+		if len(subs) == 0 {
+			delete(p.channels, channel)
+		}
+	}
+	c.removeChannel(channel)
+	return c.SubCount()
+}
+
+func (p *PubSub) PSubscribe(c *Client, pattern string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.patterns[pattern] == nil {
+		p.patterns[pattern] = make(map[*Client]bool)
+	}
+	p.patterns[pattern][c] = true
+	c.addPattern(pattern)
+	return c.SubCount()
+}
+
+func (p *PubSub) PUnsubscribe(c *Client, pattern string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if subs, ok := p.patterns[pattern]; ok {
+		delete(subs, c)
+		if len(subs) == 0 {
+			delete(p.patterns, pattern)
+		}
+	}
+	c.removePattern(pattern)
+	return c.SubCount()
+}
+
+// UnsubscribeAll drops every subscription c holds, direct or pattern. Used
+// when a subscribed connection disconnects.
+func (p *PubSub) UnsubscribeAll(c *Client) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for channel := range c.channels {
+		if subs, ok := p.channels[channel]; ok {
+			delete(subs, c)
+			if len(subs) == 0 {
+				delete(p.channels, channel)
+			}
+		}
+	}
+	for pattern := range c.patterns {
+		if subs, ok := p.patterns[pattern]; ok {
+			delete(subs, c)
+			if len(subs) == 0 {
+				delete(p.patterns, pattern)
+			}
+		}
+	}
+	c.clearSubscriptions()
+}
+
+// Publish delivers message to every direct subscriber of channel and every
+// subscriber whose pattern matches it, and reports the number of receivers.
+func (p *PubSub) Publish(channel, message string) int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	receivers := 0
+	for c := range p.channels[channel] {
+		c.Push(pushMessage(BulkStringValue("message"), BulkStringValue(channel), BulkStringValue(message)))
+		receivers++
+	}
+	for pattern, subs := range p.patterns {
+		ok, err := filepath.Match(pattern, channel)
+		if err != nil || !ok {
+			continue
+		}
+		for c := range subs {
+			c.Push(pushMessage(BulkStringValue("pmessage"), BulkStringValue(pattern), BulkStringValue(channel), BulkStringValue(message)))
+			receivers++
+		}
+	}
+	return receivers
+}
+
+// Channels returns every channel with at least one subscriber, optionally
+// filtered by a glob pattern (PUBSUB CHANNELS [pattern]).
+func (p *PubSub) Channels(pattern string) []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var channels []string
+	for channel := range p.channels {
+		if pattern == "" {
+			channels = append(channels, channel)
+			continue
+		}
+		if ok, err := filepath.Match(pattern, channel); err == nil && ok {
+			channels = append(channels, channel)
+		}
+	}
+	return channels
+}
+
+// NumSub returns the subscriber count for each requested channel (PUBSUB
+// NUMSUB [channel ...]).
+func (p *PubSub) NumSub(channels []string) map[string]int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	counts := make(map[string]int, len(channels))
+	for _, channel := range channels {
+		counts[channel] = len(p.channels[channel])
+	}
+	return counts
+}
+
+// NumPat returns the number of distinct patterns with at least one
+// subscriber (PUBSUB NUMPAT).
+func (p *PubSub) NumPat() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return len(p.patterns)
+}
+
+func pushMessage(parts ...Value) Value {
+	return Value{typ: Push, array: parts}
+}
+
+// handlePubSubIntrospect implements PUBSUB CHANNELS [pattern] | NUMSUB
+// [channel ...] | NUMPAT.
+func handlePubSubIntrospect(pubsub *PubSub, args []Value) Value {
+	if len(args) == 0 {
+		return ErrorValue("ERR wrong number of arguments for 'pubsub' command")
+	}
+	switch strings.ToLower(args[0].String()) {
+	case "channels":
+		pattern := ""
+		if len(args) > 1 {
+			pattern = args[1].String()
+		}
+		channels := pubsub.Channels(pattern)
+		reply := make([]Value, len(channels))
+		for i, channel := range channels {
+			reply[i] = BulkStringValue(channel)
+		}
+		return ArrayValue(reply)
+	case "numsub":
+		channels := make([]string, len(args)-1)
+		for i, arg := range args[1:] {
+			channels[i] = arg.String()
+		}
+		counts := pubsub.NumSub(channels)
+		reply := make([]Value, 0, len(channels)*2)
+		for _, channel := range channels {
+			reply = append(reply, BulkStringValue(channel), IntegerValue(int64(counts[channel])))
+		}
+		return ArrayValue(reply)
+	case "numpat":
+		return IntegerValue(int64(pubsub.NumPat()))
+	default:
+		return ErrorValue(fmt.Sprintf("ERR unknown PUBSUB subcommand '%s'", args[0].String()))
+	}
+}
+
+// handleConfig implements the one setting the pub/sub subsystem cares about:
+// notify-keyspace-events. Anything else is accepted as a no-op GET/SET so
+// clients that probe unrelated config keys at startup don't error out.
+func handleConfig(server *Server, args []Value) Value {
+	if len(args) < 2 {
+		return ErrorValue("ERR wrong number of arguments for 'config' command")
+	}
+	switch strings.ToLower(args[0].String()) {
+	case "set":
+		if strings.EqualFold(args[1].String(), "notify-keyspace-events") {
+			enabled := len(args) > 2 && args[2].String() != ""
+			server.pubsub.SetNotifyKeyspaceEvents(enabled)
+		}
+		return SimpleStringValue("OK")
+	case "get":
+		if strings.EqualFold(args[1].String(), "notify-keyspace-events") {
+			value := ""
+			if server.pubsub.NotifyKeyspaceEvents() {
+				value = "KEA"
+			}
+			return ArrayValue([]Value{BulkStringValue(args[1].String()), BulkStringValue(value)})
+		}
+		return ArrayValue([]Value{})
+	default:
+		return ErrorValue(fmt.Sprintf("ERR unknown CONFIG subcommand '%s'", args[0].String()))
+	}
+}
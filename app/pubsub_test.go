@@ -0,0 +1,102 @@
+package main
+
+import "testing"
+
+func TestPubSubPublishDeliversToSubscriber(t *testing.T) {
+	ps := NewPubSub()
+	c := NewClient(nil)
+	ps.Subscribe(c, "news")
+
+	if n := ps.Publish("news", "hello"); n != 1 {
+		t.Fatalf("expected 1 receiver, got %d", n)
+	}
+
+	select {
+	case got := <-c.push:
+		parts := got.Array()
+		if parts[0].String() != "message" || parts[1].String() != "news" || parts[2].String() != "hello" {
+			t.Errorf("unexpected push frame: %+v", parts)
+		}
+	default:
+		t.Fatal("expected a push frame to be queued")
+	}
+}
+
+func TestPubSubPatternMatch(t *testing.T) {
+	ps := NewPubSub()
+	c := NewClient(nil)
+	ps.PSubscribe(c, "news.*")
+
+	if n := ps.Publish("news.sports", "score"); n != 1 {
+		t.Fatalf("expected 1 receiver, got %d", n)
+	}
+	if n := ps.Publish("weather", "sunny"); n != 0 {
+		t.Fatalf("expected 0 receivers for a non-matching channel, got %d", n)
+	}
+}
+
+func TestPubSubUnsubscribeAllOnDisconnect(t *testing.T) {
+	ps := NewPubSub()
+	c := NewClient(nil)
+	ps.Subscribe(c, "news")
+	ps.PSubscribe(c, "weather.*")
+
+	ps.UnsubscribeAll(c)
+
+	if c.SubCount() != 0 {
+		t.Errorf("expected no subscriptions left, got %d", c.SubCount())
+	}
+	if n := ps.Publish("news", "hello"); n != 0 {
+		t.Errorf("expected 0 receivers after UnsubscribeAll, got %d", n)
+	}
+	if ps.NumPat() != 0 {
+		t.Errorf("expected 0 patterns left, got %d", ps.NumPat())
+	}
+}
+
+func TestPubSubNotifyEmitsKeyspaceAndKeyevent(t *testing.T) {
+	ps := NewPubSub()
+	ps.SetNotifyKeyspaceEvents(true)
+
+	keyspace := NewClient(nil)
+	ps.Subscribe(keyspace, "__keyspace@0__:foo")
+	keyevent := NewClient(nil)
+	ps.Subscribe(keyevent, "__keyevent@0__:set")
+
+	ps.Notify("set", "foo")
+
+	select {
+	case got := <-keyspace.push:
+		if got.Array()[2].String() != "set" {
+			t.Errorf("expected keyspace message payload 'set', got %q", got.Array()[2].String())
+		}
+	default:
+		t.Fatal("expected a keyspace notification")
+	}
+	select {
+	case got := <-keyevent.push:
+		if got.Array()[2].String() != "foo" {
+			t.Errorf("expected keyevent message payload 'foo', got %q", got.Array()[2].String())
+		}
+	default:
+		t.Fatal("expected a keyevent notification")
+	}
+}
+
+func TestPubSubIntrospection(t *testing.T) {
+	ps := NewPubSub()
+	a, b := NewClient(nil), NewClient(nil)
+	ps.Subscribe(a, "news")
+	ps.Subscribe(b, "news")
+	ps.PSubscribe(a, "weather.*")
+
+	if got := ps.Channels(""); len(got) != 1 || got[0] != "news" {
+		t.Errorf("expected [news], got %v", got)
+	}
+	if counts := ps.NumSub([]string{"news", "sports"}); counts["news"] != 2 || counts["sports"] != 0 {
+		t.Errorf("unexpected NumSub result: %v", counts)
+	}
+	if ps.NumPat() != 1 {
+		t.Errorf("expected 1 pattern, got %d", ps.NumPat())
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// replBacklogSize is the number of trailing bytes of RESP-encoded write
+// commands a master keeps around so a briefly-disconnected replica can
+// resume with PSYNC <replid> <offset> instead of a full resync.
+const replBacklogSize = 1 << 20 // 1MiB
+
+// replBacklog is a fixed-size ring buffer of the master's replication
+// stream. Offset N of the stream lives at ring[N % len(ring)]; once total
+// exceeds len(ring), the oldest bytes are simply overwritten.
+type replBacklog struct {
+	mu    sync.Mutex
+	ring  []byte
+	total int64 // offset just past the last byte written so far
+}
+
+func newReplBacklog(size int) *replBacklog {
+	return &replBacklog{ring: make([]byte, size)}
+}
+
+func (b *replBacklog) Write(p []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := int64(len(b.ring))
+	for _, c := range p {
+		b.ring[b.total%n] = c
+		b.total++
+	}
+}
+
+func (b *replBacklog) Offset() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.total
+}
+
+// Range returns every byte from offset `from` to the current offset, if
+// `from` still falls inside the window the ring buffer retains.
+func (b *replBacklog) Range(from int64) ([]byte, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := int64(len(b.ring))
+	valid := b.total
+	if valid > n {
+		valid = n
+	}
+	oldest := b.total - valid
+	if from < oldest || from > b.total {
+		return nil, false
+	}
+	out := make([]byte, b.total-from)
+	for i := range out {
+		out[i] = b.ring[(from+int64(i))%n]
+	}
+	return out, true
+}
+
+// Replication is the master-side replication state: a stable run id, the
+// backlog replicas resume from, and the set of connected replica Clients to
+// stream live writes to. The replica side (following another master) is
+// driven by runReplica and only touches Storage and the wire, so it needs
+// none of this.
+type Replication struct {
+	replID  string
+	backlog *replBacklog
+
+	mu       sync.RWMutex
+	replicas map[*Client]bool
+	stop     chan struct{} // non-nil while acting as a replica of another master
+}
+
+func NewReplication() *Replication {
+	return &Replication{
+		replID:   generateRunID(),
+		backlog:  newReplBacklog(replBacklogSize),
+		replicas: make(map[*Client]bool),
+	}
+}
+
+func generateRunID() string {
+	b := make([]byte, 20)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (r *Replication) AddReplica(c *Client) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.replicas[c] = true
+}
+
+// registerAndSend registers c as a replica, then calls buildPayload (meant
+// to read the backlog or snapshot storage into an RDB bulk reply) and writes
+// the result to c, all under r.mu. Propagate takes the same lock (as a read
+// lock) before pushing to every registered replica, so this is what actually
+// guarantees the resync handshake is atomic: no write can land in the gap
+// between registration and the snapshot/backlog read and be captured by
+// neither, and none can reach c's socket ahead of the handshake bytes
+// through c.pushLoop, which runs on its own goroutine and would otherwise be
+// free to win the race for c.writeMu.
+func (r *Replication) registerAndSend(c *Client, buildPayload func() []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.replicas[c] = true
+	c.writeRaw(buildPayload())
+}
+
+func (r *Replication) RemoveReplica(c *Client) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.replicas, c)
+}
+
+// Propagate re-serializes a write command, appends it to the backlog and
+// forwards it to every currently connected replica.
+func (r *Replication) Propagate(cmd Value) {
+	var buf strings.Builder
+	if err := cmd.Encode(&buf, 2); err != nil {
+		return
+	}
+	r.backlog.Write([]byte(buf.String()))
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for c := range r.replicas {
+		c.Push(cmd)
+	}
+}
+
+// StartReplicaOf begins following host:port, replacing whatever replication
+// goroutine (if any) was started by a previous REPLICAOF.
+func (r *Replication) StartReplicaOf(host, port string, storage *Storage) {
+	r.mu.Lock()
+	if r.stop != nil {
+		close(r.stop)
+	}
+	stop := make(chan struct{})
+	r.stop = stop
+	r.mu.Unlock()
+
+	go r.runReplica(host, port, storage, stop)
+}
+
+// StopReplicaOf implements REPLICAOF NO ONE: stop following a master.
+func (r *Replication) StopReplicaOf() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stop != nil {
+		close(r.stop)
+		r.stop = nil
+	}
+}
+
+// runReplica repeatedly connects to a master and replicates from it,
+// reconnecting with exponential backoff when the connection drops.
+func (r *Replication) runReplica(host, port string, storage *Storage, stop chan struct{}) {
+	backoff := 500 * time.Millisecond
+	const maxBackoff = 10 * time.Second
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		if err := replicateOnce(host, port, storage, stop); err != nil {
+			fmt.Printf("replication from %s:%s failed: %s\n", host, port, err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff < maxBackoff {
+			backoff *= 2
+		}
+	}
+}
+
+// replicateOnce performs the PSYNC handshake against one master connection
+// and then applies its write stream to storage until the connection drops
+// or stop is closed. Replies are never sent back: a replica is silent.
+func replicateOnce(host, port string, storage *Storage, stop chan struct{}) error {
+	conn, err := net.Dial("tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	send := func(parts ...string) error {
+		values := make([]Value, len(parts))
+		for i, p := range parts {
+			values[i] = BulkStringValue(p)
+		}
+		cmd := ArrayValue(values)
+		return cmd.Encode(conn, 2)
+	}
+
+	if err := send("ping"); err != nil {
+		return err
+	}
+	if _, err := DecodeRESP(reader); err != nil {
+		return err
+	}
+	if err := send("replconf", "listening-port", "0"); err != nil {
+		return err
+	}
+	if _, err := DecodeRESP(reader); err != nil {
+		return err
+	}
+	if err := send("psync", "?", "-1"); err != nil {
+		return err
+	}
+	if _, err := DecodeRESP(reader); err != nil { // +FULLRESYNC <replid> <offset>
+		return err
+	}
+	rdbReply, err := DecodeRESP(reader) // bulk string snapshot
+	if err != nil {
+		return err
+	}
+	storage.Clear()
+	if err := decodeRDB([]byte(rdbReply.String()), storage); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+		value, err := DecodeRESP(reader)
+		if err != nil {
+			return err
+		}
+		args := value.Array()
+		if len(args) == 0 {
+			continue
+		}
+		applyWriteCommand(storage, strings.ToLower(args[0].String()), args[1:])
+	}
+}
+
+// handlePSync answers a replica's PSYNC <replid> <offset> request: either a
+// +CONTINUE plus the missed backlog bytes if the requested offset is still
+// in the window, or a full +FULLRESYNC handshake followed by an RDB
+// snapshot otherwise. Either way the client is registered to receive future
+// writes once this returns.
+func handlePSync(client *Client, server *Server, args []Value) {
+	if len(args) < 2 {
+		client.Reply(ErrorValue("ERR wrong number of arguments for 'psync' command"))
+		return
+	}
+	repl := server.repl
+	replID, offsetArg := args[0].String(), args[1].String()
+
+	if replID != "?" && offsetArg != "-1" {
+		if offset, err := strconv.ParseInt(offsetArg, 10, 64); err == nil && replID == repl.replID {
+			if data, ok := repl.backlog.Range(offset); ok {
+				repl.registerAndSend(client, func() []byte {
+					var buf bytes.Buffer
+					continueReply := SimpleStringValue("CONTINUE")
+					continueReply.Encode(&buf, client.protocol)
+					buf.Write(data)
+					return buf.Bytes()
+				})
+				return
+			}
+		}
+	}
+
+	// registerAndSend registers the replica and snapshots storage under the
+	// same lock Propagate reads, so no write can fall into the gap between
+	// registration and the snapshot (captured by neither), and none can
+	// reach the wire ahead of the FULLRESYNC+RDB payload via c.pushLoop,
+	// which runs on its own goroutine and would otherwise race it there.
+	repl.registerAndSend(client, func() []byte {
+		var buf bytes.Buffer
+		fullresync := SimpleStringValue(fmt.Sprintf("FULLRESYNC %s %d", repl.replID, repl.backlog.Offset()))
+		rdb := BulkStringValue(string(encodeRDB(server.storage)))
+		fullresync.Encode(&buf, client.protocol)
+		rdb.Encode(&buf, client.protocol)
+		return buf.Bytes()
+	})
+}
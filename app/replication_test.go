@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+func TestReplBacklogRange(t *testing.T) {
+	b := newReplBacklog(8)
+	b.Write([]byte("abcd"))
+
+	if b.Offset() != 4 {
+		t.Fatalf("expected offset 4, got %d", b.Offset())
+	}
+	data, ok := b.Range(0)
+	if !ok || string(data) != "abcd" {
+		t.Fatalf("expected 'abcd' from offset 0, got %q ok=%v", data, ok)
+	}
+
+	// Push the buffer past its capacity so offset 0 falls out of the window.
+	b.Write([]byte("efghijkl"))
+	if _, ok := b.Range(0); ok {
+		t.Errorf("expected offset 0 to no longer be in the backlog window")
+	}
+	data, ok = b.Range(b.Offset() - 4)
+	if !ok || string(data) != "ijkl" {
+		t.Errorf("expected trailing 'ijkl', got %q ok=%v", data, ok)
+	}
+}
+
+func TestReplicationPropagateForwardsToReplica(t *testing.T) {
+	repl := NewReplication()
+	client := NewClient(nil)
+	repl.AddReplica(client)
+
+	cmd := ArrayValue([]Value{BulkStringValue("set"), BulkStringValue("foo"), BulkStringValue("bar")})
+	repl.Propagate(cmd)
+
+	select {
+	case got := <-client.push:
+		if got.String() != "" || len(got.Array()) != 3 {
+			t.Errorf("expected the propagated SET command on the replica's push channel")
+		}
+	default:
+		t.Errorf("expected a push frame to be queued for the replica")
+	}
+
+	if repl.backlog.Offset() == 0 {
+		t.Errorf("expected Propagate to advance the backlog offset")
+	}
+}
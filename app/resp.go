@@ -0,0 +1,482 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Type identifies the RESP wire type of a Value. RESP2 only ever produces
+// SimpleString, Error, Integer, BulkString and Array; everything else is
+// RESP3-only and is downgraded by Encode when the connection is still
+// speaking RESP2.
+type Type byte
+
+const (
+	SimpleString   Type = '+'
+	Error          Type = '-'
+	Integer        Type = ':'
+	BulkString     Type = '$'
+	Array          Type = '*'
+	Null           Type = '_'
+	Double         Type = ','
+	Boolean        Type = '#'
+	BigNumber      Type = '('
+	BulkError      Type = '!'
+	VerbatimString Type = '='
+	Map            Type = '%'
+	Set            Type = '~'
+	Attribute      Type = '|'
+	Push           Type = '>'
+)
+
+// Value is a decoded (or about-to-be-encoded) RESP value. Map, Set and Push
+// reuse array like Array does: a Map's array holds 2*N elements, alternating
+// key and value.
+type Value struct {
+	typ   Type
+	bytes []byte
+	array []Value
+	attr  *Value // RESP3 attribute map that preceded this value, if any
+}
+
+func (v *Value) String() string {
+	if v.typ == BulkString || v.typ == SimpleString || v.typ == VerbatimString {
+		return string(v.bytes)
+	}
+	return ""
+}
+
+func (v *Value) Array() []Value {
+	switch v.typ {
+	case Array, Map, Set, Push:
+		return v.array
+	}
+	return []Value{}
+}
+
+// IsNull reports whether v is a RESP nil reply: a null bulk string or null
+// array in RESP2, or the dedicated Null type in RESP3.
+func (v *Value) IsNull() bool {
+	return v.typ == Null || (v.typ == BulkString && v.bytes == nil) || (v.typ == Array && v.array == nil)
+}
+
+// IsError reports whether v is a RESP error reply (Error or BulkError).
+func (v *Value) IsError() bool {
+	return v.typ == Error || v.typ == BulkError
+}
+
+func NullValue() Value {
+	return Value{typ: Null}
+}
+
+func SimpleStringValue(s string) Value {
+	return Value{typ: SimpleString, bytes: []byte(s)}
+}
+
+func ErrorValue(s string) Value {
+	return Value{typ: Error, bytes: []byte(s)}
+}
+
+func IntegerValue(n int64) Value {
+	return Value{typ: Integer, bytes: []byte(strconv.FormatInt(n, 10))}
+}
+
+func BulkStringValue(s string) Value {
+	return Value{typ: BulkString, bytes: []byte(s)}
+}
+
+func ArrayValue(items []Value) Value {
+	return Value{typ: Array, array: items}
+}
+
+// NullArrayValue returns a RESP null array reply (*-1\r\n in RESP2, the same
+// dedicated Null type as NullValue in RESP3). Used where the reply is
+// expected to be a multi-bulk array but there's nothing to return, as
+// opposed to NullValue's null bulk string — a client parsing the reply as
+// an array would otherwise mis-parse a null bulk string in its place.
+func NullArrayValue() Value {
+	return Value{typ: Array, array: nil}
+}
+
+func DecodeRESP(reader *bufio.Reader) (Value, error) {
+	dataTypeByte, err := reader.ReadByte()
+	if err != nil {
+		return Value{}, err
+	}
+
+	switch string(dataTypeByte) {
+	case "+":
+		return decodeSimpleString(reader)
+	case "-":
+		return decodeError(reader)
+	case ":":
+		return decodeInteger(reader)
+	case "$":
+		return decodeBulkString(reader)
+	case "*":
+		return decodeArray(reader)
+	case "_":
+		return decodeNull(reader)
+	case ",":
+		return decodeDouble(reader)
+	case "#":
+		return decodeBoolean(reader)
+	case "(":
+		return decodeBigNumber(reader)
+	case "!":
+		return decodeBulkError(reader)
+	case "=":
+		return decodeVerbatimString(reader)
+	case "%":
+		return decodeMap(reader)
+	case "~":
+		return decodeSet(reader)
+	case "|":
+		return decodeAttribute(reader)
+	case ">":
+		return decodePush(reader)
+	}
+	return Value{}, fmt.Errorf("Invalid RESP data type byte: %s", string(dataTypeByte))
+}
+
+func decodeSimpleString(reader *bufio.Reader) (Value, error) {
+	bytes, err := readUntilCRLF(reader)
+	if err != nil {
+		return Value{}, err
+	}
+	return Value{
+		typ:   SimpleString,
+		bytes: bytes,
+	}, nil
+}
+
+func decodeError(reader *bufio.Reader) (Value, error) {
+	bytes, err := readUntilCRLF(reader)
+	if err != nil {
+		return Value{}, err
+	}
+	return Value{
+		typ:   Error,
+		bytes: bytes,
+	}, nil
+}
+
+func decodeInteger(reader *bufio.Reader) (Value, error) {
+	bytes, err := readUntilCRLF(reader)
+	if err != nil {
+		return Value{}, err
+	}
+	if _, err := strconv.ParseInt(string(bytes), 10, 64); err != nil {
+		return Value{}, fmt.Errorf("invalid RESP integer %q: %w", bytes, err)
+	}
+	return Value{
+		typ:   Integer,
+		bytes: bytes,
+	}, nil
+}
+
+func decodeBulkString(reader *bufio.Reader) (Value, error) {
+	countBytes, err := readUntilCRLF(reader)
+	if err != nil {
+		return Value{}, err
+	}
+	count, err := strconv.Atoi(string(countBytes))
+	if err != nil {
+		return Value{}, err
+	}
+	if count < 0 {
+		// Null bulk string ($-1\r\n).
+		return Value{typ: BulkString, bytes: nil}, nil
+	}
+	bytes := make([]byte, count+2)
+	if _, err := io.ReadFull(reader, bytes); err != nil {
+		return Value{}, err
+	}
+	return Value{
+		typ:   BulkString,
+		bytes: bytes[:count],
+	}, nil
+
+}
+
+func decodeNull(reader *bufio.Reader) (Value, error) {
+	if _, err := readUntilCRLF(reader); err != nil {
+		return Value{}, err
+	}
+	return Value{typ: Null}, nil
+}
+
+func decodeDouble(reader *bufio.Reader) (Value, error) {
+	bytes, err := readUntilCRLF(reader)
+	if err != nil {
+		return Value{}, err
+	}
+	return Value{typ: Double, bytes: bytes}, nil
+}
+
+func decodeBoolean(reader *bufio.Reader) (Value, error) {
+	bytes, err := readUntilCRLF(reader)
+	if err != nil {
+		return Value{}, err
+	}
+	return Value{typ: Boolean, bytes: bytes}, nil
+}
+
+func decodeBigNumber(reader *bufio.Reader) (Value, error) {
+	bytes, err := readUntilCRLF(reader)
+	if err != nil {
+		return Value{}, err
+	}
+	return Value{typ: BigNumber, bytes: bytes}, nil
+}
+
+func decodeBulkError(reader *bufio.Reader) (Value, error) {
+	v, err := decodeBulkString(reader)
+	if err != nil {
+		return Value{}, err
+	}
+	v.typ = BulkError
+	return v, nil
+}
+
+func decodeVerbatimString(reader *bufio.Reader) (Value, error) {
+	v, err := decodeBulkString(reader)
+	if err != nil {
+		return Value{}, err
+	}
+	v.typ = VerbatimString
+	return v, nil
+}
+
+func decodeArray(reader *bufio.Reader) (Value, error) {
+	countBytes, err := readUntilCRLF(reader)
+	if err != nil {
+		return Value{}, err
+	}
+	count, err := strconv.Atoi(string(countBytes))
+	if err != nil {
+		return Value{}, err
+	}
+	array := []Value{}
+	for i := 1; i <= count; i++ {
+		value, err := DecodeRESP(reader)
+		if err != nil {
+			return Value{}, err
+		}
+		array = append(array, value)
+	}
+	return Value{
+		typ:   Array,
+		array: array,
+	}, nil
+}
+
+func decodeMap(reader *bufio.Reader) (Value, error) {
+	v, err := decodeAggregate(reader, 2)
+	if err != nil {
+		return Value{}, err
+	}
+	v.typ = Map
+	return v, nil
+}
+
+func decodeSet(reader *bufio.Reader) (Value, error) {
+	v, err := decodeAggregate(reader, 1)
+	if err != nil {
+		return Value{}, err
+	}
+	v.typ = Set
+	return v, nil
+}
+
+func decodePush(reader *bufio.Reader) (Value, error) {
+	v, err := decodeAggregate(reader, 1)
+	if err != nil {
+		return Value{}, err
+	}
+	v.typ = Push
+	return v, nil
+}
+
+// decodeAttribute reads a RESP3 attribute map and attaches it to the value
+// that follows it, which is what the attribute actually describes.
+func decodeAttribute(reader *bufio.Reader) (Value, error) {
+	attr, err := decodeAggregate(reader, 2)
+	if err != nil {
+		return Value{}, err
+	}
+	attr.typ = Attribute
+	value, err := DecodeRESP(reader)
+	if err != nil {
+		return Value{}, err
+	}
+	value.attr = &attr
+	return value, nil
+}
+
+// decodeAggregate reads a <count>\r\n header followed by count*elemsPerEntry
+// RESP values, as used by maps (2 values per entry), sets and pushes (1).
+func decodeAggregate(reader *bufio.Reader, elemsPerEntry int) (Value, error) {
+	countBytes, err := readUntilCRLF(reader)
+	if err != nil {
+		return Value{}, err
+	}
+	count, err := strconv.Atoi(string(countBytes))
+	if err != nil {
+		return Value{}, err
+	}
+	array := []Value{}
+	for i := 0; i < count*elemsPerEntry; i++ {
+		value, err := DecodeRESP(reader)
+		if err != nil {
+			return Value{}, err
+		}
+		array = append(array, value)
+	}
+	return Value{array: array}, nil
+}
+
+func readUntilCRLF(reader *bufio.Reader) ([]byte, error) {
+	bytes, err := reader.ReadBytes('\n')
+	if err != nil {
+		return []byte{}, err
+	}
+	return bytes[:len(bytes)-2], nil
+}
+
+// Encode writes v to w using the given RESP protocol version (2 or 3).
+// RESP3-only types are downgraded to their closest RESP2 equivalent when
+// protocol is 2, so the same Value can answer a client on either dialect.
+func (v *Value) Encode(w io.Writer, protocol int) error {
+	switch v.typ {
+	case SimpleString:
+		_, err := fmt.Fprintf(w, "+%s\r\n", v.bytes)
+		return err
+	case Error:
+		_, err := fmt.Fprintf(w, "-%s\r\n", v.bytes)
+		return err
+	case Integer:
+		_, err := fmt.Fprintf(w, ":%s\r\n", v.bytes)
+		return err
+	case BulkString:
+		if v.bytes == nil {
+			_, err := fmt.Fprint(w, "$-1\r\n")
+			return err
+		}
+		_, err := fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v.bytes), v.bytes)
+		return err
+	case Null:
+		if protocol >= 3 {
+			_, err := fmt.Fprint(w, "_\r\n")
+			return err
+		}
+		_, err := fmt.Fprint(w, "$-1\r\n")
+		return err
+	case Double:
+		if protocol >= 3 {
+			_, err := fmt.Fprintf(w, ",%s\r\n", v.bytes)
+			return err
+		}
+		_, err := fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v.bytes), v.bytes)
+		return err
+	case Boolean:
+		if protocol >= 3 {
+			_, err := fmt.Fprintf(w, "#%s\r\n", v.bytes)
+			return err
+		}
+		n := 0
+		if string(v.bytes) == "t" {
+			n = 1
+		}
+		_, err := fmt.Fprintf(w, ":%d\r\n", n)
+		return err
+	case BigNumber:
+		if protocol >= 3 {
+			_, err := fmt.Fprintf(w, "(%s\r\n", v.bytes)
+			return err
+		}
+		_, err := fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v.bytes), v.bytes)
+		return err
+	case BulkError:
+		if protocol >= 3 {
+			_, err := fmt.Fprintf(w, "!%d\r\n%s\r\n", len(v.bytes), v.bytes)
+			return err
+		}
+		_, err := fmt.Fprintf(w, "-%s\r\n", v.bytes)
+		return err
+	case VerbatimString:
+		if protocol >= 3 {
+			_, err := fmt.Fprintf(w, "=%d\r\n%s\r\n", len(v.bytes), v.bytes)
+			return err
+		}
+		text := v.bytes
+		if len(text) >= 4 && text[3] == ':' {
+			text = text[4:]
+		}
+		_, err := fmt.Fprintf(w, "$%d\r\n%s\r\n", len(text), text)
+		return err
+	case Array:
+		if v.array == nil {
+			if protocol >= 3 {
+				_, err := fmt.Fprint(w, "_\r\n")
+				return err
+			}
+			_, err := fmt.Fprint(w, "*-1\r\n")
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "*%d\r\n", len(v.array)); err != nil {
+			return err
+		}
+		for i := range v.array {
+			if err := v.array[i].Encode(w, protocol); err != nil {
+				return err
+			}
+		}
+		return nil
+	case Map:
+		if protocol >= 3 {
+			if _, err := fmt.Fprintf(w, "%%%d\r\n", len(v.array)/2); err != nil {
+				return err
+			}
+		} else if _, err := fmt.Fprintf(w, "*%d\r\n", len(v.array)); err != nil {
+			return err
+		}
+		for i := range v.array {
+			if err := v.array[i].Encode(w, protocol); err != nil {
+				return err
+			}
+		}
+		return nil
+	case Set:
+		if protocol >= 3 {
+			if _, err := fmt.Fprintf(w, "~%d\r\n", len(v.array)); err != nil {
+				return err
+			}
+		} else if _, err := fmt.Fprintf(w, "*%d\r\n", len(v.array)); err != nil {
+			return err
+		}
+		for i := range v.array {
+			if err := v.array[i].Encode(w, protocol); err != nil {
+				return err
+			}
+		}
+		return nil
+	case Push:
+		if protocol >= 3 {
+			if _, err := fmt.Fprintf(w, ">%d\r\n", len(v.array)); err != nil {
+				return err
+			}
+		} else if _, err := fmt.Fprintf(w, "*%d\r\n", len(v.array)); err != nil {
+			return err
+		}
+		for i := range v.array {
+			if err := v.array[i].Encode(w, protocol); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("cannot encode RESP value of type %q", byte(v.typ))
+}
@@ -2,234 +2,392 @@ package main
 
 import (
 	"bufio"
+	"flag"
 	"fmt"
-	"io"
 	"net"
 	"os"
 	"strconv"
-	"time"
+	"strings"
+	"sync"
 )
 
+// defaultSavePoints mirrors Redis's stock redis.conf: save if at least 1
+// key changed in the last 900s, or 10 in the last 300s, or 10000 in the
+// last 60s.
+var defaultSavePoints = []SavePoint{
+	{Seconds: 900, Changes: 1},
+	{Seconds: 300, Changes: 10},
+	{Seconds: 60, Changes: 10000},
+}
+
+// Server is the shared state every connection's goroutine reads and
+// mutates: the dataset itself plus the persistence subsystems that back it.
+type Server struct {
+	storage *Storage
+	rdb     *RDB
+	aof     *AOF // nil unless --appendonly is set
+	repl    *Replication
+	pubsub  *PubSub
+
+	commands map[string]*CommandSpec
+
+	// execMu guards write execution: EXEC holds it for its whole queued
+	// batch, and handleConnection also takes it around every ordinary write
+	// command, so an ordinary SET from one connection can never run between
+	// two commands of another connection's transaction. Read-only commands
+	// don't take it, since they can't break WATCH/EXEC's atomicity.
+	execMu sync.Mutex
+}
+
 func main() {
+	dir := flag.String("dir", ".", "directory for RDB/AOF persistence files")
+	dbfilename := flag.String("dbfilename", "dump.rdb", "RDB snapshot filename")
+	appendonly := flag.Bool("appendonly", false, "enable append-only file persistence")
+	appendfilename := flag.String("appendfilename", "appendonly.aof", "AOF filename")
+	flag.Parse()
+
+	storage := NewStorage()
+	rdb := NewRDB(*dir, *dbfilename)
+
+	var aof *AOF
+	if *appendonly {
+		var err error
+		aof, err = NewAOF(*dir, *appendfilename, AOFEverySec)
+		if err != nil {
+			fmt.Println("Failed to open append-only file:", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	// Prefer the AOF when present: it is strictly more up to date than the
+	// last RDB snapshot, since every write is logged as it happens.
+	if aof != nil {
+		if err := aof.Load(storage); err != nil {
+			fmt.Println("Failed to replay append-only file:", err.Error())
+			os.Exit(1)
+		}
+	} else if err := rdb.Load(storage); err != nil {
+		fmt.Println("Failed to load RDB snapshot:", err.Error())
+		os.Exit(1)
+	}
+
+	go rdb.RunSavePolicy(storage, defaultSavePoints)
+
+	pubsub := NewPubSub()
+	storage.SetNotifier(pubsub)
+
+	server := &Server{storage: storage, rdb: rdb, aof: aof, repl: NewReplication(), pubsub: pubsub}
+	server.commands = newCommandTable(server)
+
 	l, err := net.Listen("tcp", "0.0.0.0:6379")
 	if err != nil {
 		fmt.Println("Failed to bind to port 6379")
 		os.Exit(1)
 	}
-	storage := NewStorage()
 	for {
 		conn, err := l.Accept()
 		if err != nil {
 			fmt.Println("Failed to accept connection: ", err.Error())
 			os.Exit(1)
 		}
-		go handleConnection(conn, storage)
+		go handleConnection(conn, server)
 	}
 }
 
-type Storage struct {
-	data map[string]ValueWithExpiry
-}
+// Client tracks the state the server keeps for one connection: which RESP
+// dialect it negotiated via HELLO, and the channel out-of-band push frames
+// (pub/sub messages, keyspace notifications, ...) are queued on so they can
+// be interleaved with normal command replies without corrupting the wire.
+type Client struct {
+	conn     net.Conn
+	protocol int // 2 or 3
 
-func NewStorage() *Storage {
-	return &Storage{
-		data: make(map[string]ValueWithExpiry),
-	}
-}
+	writeMu sync.Mutex
+	push    chan Value
+	done    chan struct{}
+
+	subMu    sync.Mutex
+	channels map[string]bool
+	patterns map[string]bool
 
-func (s *Storage) Set(key string, value string) {
-	s.data[key] = ValueWithExpiry{value: value}
+	// multi holds the MULTI/EXEC/WATCH state for this connection. It is
+	// only ever touched by this connection's own goroutine, so it needs no
+	// lock of its own.
+	multi multiState
 }
 
-func (s *Storage) SetWithExpiry(key string, value string, expiry time.Duration) {
-	s.data[key] = ValueWithExpiry{
-		value:     value,
-		expiresAt: time.Now().Add(expiry),
+func NewClient(conn net.Conn) *Client {
+	return &Client{
+		conn:     conn,
+		protocol: 2,
+		push:     make(chan Value, 64),
+		done:     make(chan struct{}),
+		channels: make(map[string]bool),
+		patterns: make(map[string]bool),
 	}
 }
 
-func (s *Storage) Get(key string) (string, bool) {
-	valueWithExpiry, ok := s.data[key]
-	if !ok {
-		return "", false
-	}
-	if valueWithExpiry.IsExpired() {
-		delete(s.data, key)
-		return "", false
-	}
-	return valueWithExpiry.value, true
+func (c *Client) addChannel(channel string) {
+	c.subMu.Lock()
+	defer c.subMu.Unlock()
+	c.channels[channel] = true
 }
 
-func handleConnection(conn net.Conn, storage *Storage) {
-	defer conn.Close()
+func (c *Client) removeChannel(channel string) {
+	c.subMu.Lock()
+	defer c.subMu.Unlock()
+	delete(c.channels, channel)
+}
 
-	for {
-		if _, err := conn.Read([]byte{}); err != nil {
-			fmt.Println("Failed to read from client: ", err.Error())
-			continue
-		}
-		value, err := DecodeRESP(bufio.NewReader(conn))
-		if err != nil {
-			fmt.Println("Failed to decode RESP", err.Error())
-			return
-		}
-		command := value.Array()[0].String()
-		args := value.Array()[1:]
+func (c *Client) addPattern(pattern string) {
+	c.subMu.Lock()
+	defer c.subMu.Unlock()
+	c.patterns[pattern] = true
+}
 
-		switch command {
-		case "ping":
-			conn.Write([]byte("+PONG\r\n"))
-		case "echo":
-			conn.Write([]byte(fmt.Sprintf("$%d\r\n%s\r\n", len(args[0].String()), args[0].String())))
-		case "set":
-			if len(args) > 2 {
-				if args[2].String() == "px" {
-					expiry, err := strconv.Atoi(args[3].String())
-					if err != nil {
-						conn.Write([]byte(fmt.Sprintf("-ERR invalid PX value: %s\r\n", args[3].String())))
-						break
-					}
-					storage.SetWithExpiry(args[0].String(), args[1].String(), time.Duration(expiry)*time.Millisecond)
-				} else {
-					conn.Write([]byte(fmt.Sprintf("-ERR invalid option for set: %s\r\n", args[3].String())))
-					break
-				}
-			} else {
-				storage.Set(args[0].String(), args[1].String())
-			}
-			conn.Write([]byte("+OK\r\n"))
-		case "get":
-			value, found := storage.Get(args[0].String())
-			if found {
-				conn.Write([]byte(fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)))
-			} else {
-				conn.Write([]byte("$-1\r\n"))
-			}
-		default:
-			conn.Write([]byte(fmt.Sprintf("-ERR unknown command '%s'\r\n", command)))
-		}
-	}
+func (c *Client) removePattern(pattern string) {
+	c.subMu.Lock()
+	defer c.subMu.Unlock()
+	delete(c.patterns, pattern)
 }
 
-type Type byte
+// clearSubscriptions drops every channel and pattern subscription tracked on
+// the client side. Called by PubSub.UnsubscribeAll once it has removed c from
+// its own indexes, keeping the two sides in sync.
+func (c *Client) clearSubscriptions() {
+	c.subMu.Lock()
+	defer c.subMu.Unlock()
+	c.channels = make(map[string]bool)
+	c.patterns = make(map[string]bool)
+}
 
-const (
-	SimpleString Type = '+'
-	BulkString   Type = '$'
-	Array        Type = '*'
-)
+// SubCount is the total number of channel and pattern subscriptions this
+// client holds; non-zero means it is in the restricted subscriber mode.
+func (c *Client) SubCount() int {
+	c.subMu.Lock()
+	defer c.subMu.Unlock()
+	return len(c.channels) + len(c.patterns)
+}
 
-type Value struct {
-	typ   Type
-	bytes []byte
-	array []Value
+// Reply writes a command's result to the client, synchronized with any push
+// frames sent concurrently from c.pushLoop.
+func (c *Client) Reply(v Value) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	v.Encode(c.conn, c.protocol)
 }
 
-func (v *Value) String() string {
-	if v.typ == BulkString || v.typ == SimpleString {
-		return string(v.bytes)
-	}
-	return ""
+// writeRaw writes pre-encoded bytes directly to the connection, still
+// synchronized against concurrent replies and push frames. Used for the
+// replication backlog, which is already RESP-encoded.
+func (c *Client) writeRaw(b []byte) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.Write(b)
 }
 
-func (v *Value) Array() []Value {
-	if v.typ == Array {
-		return v.array
+// Push enqueues an out-of-band frame (e.g. a pub/sub message) to be written
+// to the client as soon as the write side is free.
+func (c *Client) Push(v Value) {
+	select {
+	case c.push <- v:
+	case <-c.done:
 	}
-	return []Value{}
 }
 
-func DecodeRESP(reader *bufio.Reader) (Value, error) {
-	dataTypeByte, err := reader.ReadByte()
-	if err != nil {
-		return Value{}, err
+// pushLoop is the write side referenced by handleConnection: it drains
+// c.push and writes each frame using the client's negotiated protocol,
+// interleaved with ordinary replies via writeMu.
+func (c *Client) pushLoop() {
+	for {
+		select {
+		case v := <-c.push:
+			c.writeMu.Lock()
+			v.Encode(c.conn, c.protocol)
+			c.writeMu.Unlock()
+		case <-c.done:
+			return
+		}
 	}
+}
 
-	switch string(dataTypeByte) {
-	case "+":
-		return decodeSimpleString(reader)
-	case "$":
-		return decodeBulkString(reader)
-	case "*":
-		return decodeArray(reader)
-	}
-	return Value{}, fmt.Errorf("Invalid RESP data type byte: %s", string(dataTypeByte))
+func (c *Client) Close() {
+	close(c.done)
 }
 
-func decodeSimpleString(reader *bufio.Reader) (Value, error) {
-	bytes, err := readUntilCRLF(reader)
-	if err != nil {
-		return Value{}, err
-	}
-	return Value{
-		typ:   SimpleString,
-		bytes: bytes,
-	}, nil
+// subscriberModeAllowed is the full set of commands a connection may still
+// issue once it holds at least one channel or pattern subscription.
+var subscriberModeAllowed = map[string]bool{
+	"subscribe": true, "unsubscribe": true,
+	"psubscribe": true, "punsubscribe": true,
+	"ping": true, "quit": true,
 }
 
-func decodeBulkString(reader *bufio.Reader) (Value, error) {
-	countBytes, err := readUntilCRLF(reader)
-	if err != nil {
-		return Value{}, err
+// propagate logs a write command to the AOF (when enabled) and replicates
+// it to connected replicas, once its handler has produced a non-error
+// reply. full is the original, already-decoded RESP array for the command,
+// which is what gets replayed verbatim on the other end.
+func propagate(server *Server, spec *CommandSpec, full Value, reply Value) {
+	if spec.Flags&CmdWrite == 0 || reply.IsError() {
+		return
 	}
-	count, err := strconv.Atoi(string(countBytes))
-	if err != nil {
-		return Value{}, err
+	if server.aof != nil {
+		server.aof.Append(full)
 	}
-	bytes := make([]byte, count+2)
-	if _, err := io.ReadFull(reader, bytes); err != nil {
-		return Value{}, err
-	}
-	return Value{
-		typ:   BulkString,
-		bytes: bytes[:count],
-	}, nil
-
+	server.repl.Propagate(full)
 }
 
-func decodeInteger() {}
+func handleConnection(conn net.Conn, server *Server) {
+	defer conn.Close()
 
-func decodeError() {}
+	client := NewClient(conn)
+	go client.pushLoop()
+	defer client.Close()
+	defer server.repl.RemoveReplica(client)
+	defer server.pubsub.UnsubscribeAll(client)
 
-func decodeArray(reader *bufio.Reader) (Value, error) {
-	countBytes, err := readUntilCRLF(reader)
-	if err != nil {
-		return Value{}, err
-	}
-	count, err := strconv.Atoi(string(countBytes))
-	if err != nil {
-		return Value{}, err
-	}
-	array := []Value{}
-	for i := 1; i <= count; i++ {
+	reader := bufio.NewReader(conn)
+	for {
 		value, err := DecodeRESP(reader)
 		if err != nil {
-			return Value{}, err
+			fmt.Println("Failed to decode RESP", err.Error())
+			return
 		}
-		array = append(array, value)
-	}
-	return Value{
-		typ:   Array,
-		array: array,
-	}, nil
-}
+		// Command names arrive in whatever case the client sent; every
+		// registry key and switch case below is lowercase, so normalize
+		// here rather than at each call site.
+		command := strings.ToLower(value.Array()[0].String())
+		args := value.Array()[1:]
 
-func readUntilCRLF(reader *bufio.Reader) ([]byte, error) {
-	bytes, err := reader.ReadBytes('\n')
-	if err != nil {
-		return []byte{}, err
+		if client.SubCount() > 0 && !subscriberModeAllowed[command] {
+			client.Reply(ErrorValue(fmt.Sprintf("ERR Can't execute '%s': only (P|S)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context", command)))
+			continue
+		}
+
+		// These commands don't fit the registry's "one reply in, one reply
+		// out" shape: the SUBSCRIBE family replies once per argument, and
+		// MULTI/EXEC/DISCARD/WATCH/UNWATCH read and write connection-level
+		// state the handler signature has no room for.
+		switch command {
+		case "subscribe":
+			for _, arg := range args {
+				count := server.pubsub.Subscribe(client, arg.String())
+				client.Reply(pushMessage(BulkStringValue("subscribe"), BulkStringValue(arg.String()), IntegerValue(int64(count))))
+			}
+			continue
+		case "unsubscribe":
+			channels := args
+			if len(channels) == 0 {
+				client.subMu.Lock()
+				for channel := range client.channels {
+					channels = append(channels, BulkStringValue(channel))
+				}
+				client.subMu.Unlock()
+			}
+			for _, arg := range channels {
+				count := server.pubsub.Unsubscribe(client, arg.String())
+				client.Reply(pushMessage(BulkStringValue("unsubscribe"), BulkStringValue(arg.String()), IntegerValue(int64(count))))
+			}
+			continue
+		case "psubscribe":
+			for _, arg := range args {
+				count := server.pubsub.PSubscribe(client, arg.String())
+				client.Reply(pushMessage(BulkStringValue("psubscribe"), BulkStringValue(arg.String()), IntegerValue(int64(count))))
+			}
+			continue
+		case "punsubscribe":
+			patterns := args
+			if len(patterns) == 0 {
+				client.subMu.Lock()
+				for pattern := range client.patterns {
+					patterns = append(patterns, BulkStringValue(pattern))
+				}
+				client.subMu.Unlock()
+			}
+			for _, arg := range patterns {
+				count := server.pubsub.PUnsubscribe(client, arg.String())
+				client.Reply(pushMessage(BulkStringValue("punsubscribe"), BulkStringValue(arg.String()), IntegerValue(int64(count))))
+			}
+			continue
+		case "psync":
+			handlePSync(client, server, args)
+			continue
+		case "multi":
+			client.Reply(handleMulti(client, args))
+			continue
+		case "discard":
+			client.Reply(handleDiscard(client, args))
+			continue
+		case "watch":
+			client.Reply(handleWatch(client, server.storage, args))
+			continue
+		case "unwatch":
+			client.Reply(handleUnwatch(client, args))
+			continue
+		case "exec":
+			client.Reply(handleExec(client, server))
+			continue
+		}
+
+		spec, ok := server.commands[command]
+		if !ok {
+			client.multi.dirty = client.multi.active
+			client.Reply(ErrorValue(fmt.Sprintf("ERR unknown command '%s'", command)))
+			continue
+		}
+		if !spec.checkArity(args) {
+			client.multi.dirty = client.multi.active
+			client.Reply(ErrorValue(fmt.Sprintf("ERR wrong number of arguments for '%s' command", command)))
+			continue
+		}
+
+		if client.multi.active {
+			client.multi.queue = append(client.multi.queue, queuedCommand{name: command, args: args, full: value})
+			client.Reply(SimpleStringValue("QUEUED"))
+			continue
+		}
+
+		// Take execMu for write commands so they can't land in the middle of
+		// another connection's EXEC batch, which holds the same lock for its
+		// whole queue; see the field comment on Server.execMu.
+		if spec.Flags&CmdWrite != 0 {
+			server.execMu.Lock()
+			reply := spec.Handler(client, args)
+			server.execMu.Unlock()
+			client.Reply(reply)
+			propagate(server, spec, value, reply)
+			continue
+		}
+
+		reply := spec.Handler(client, args)
+		client.Reply(reply)
+		propagate(server, spec, value, reply)
 	}
-	return bytes[:len(bytes)-2], nil
 }
 
-type ValueWithExpiry struct {
-	value     string
-	expiresAt time.Time
-}
+// handleHello implements the RESP3 handshake: HELLO [protover [AUTH ...] [SETNAME ...]].
+// With no argument it just reports the currently negotiated protocol; with a
+// protover argument it upgrades (or keeps) the connection on that dialect,
+// defaulting to RESP2 until asked otherwise.
+func handleHello(c *Client, args []Value) Value {
+	protocol := c.protocol
+	if len(args) > 0 {
+		requested, err := strconv.Atoi(args[0].String())
+		if err != nil || (requested != 2 && requested != 3) {
+			return ErrorValue("NOPROTO unsupported protocol version")
+		}
+		protocol = requested
+	}
+	c.protocol = protocol
 
-func (v ValueWithExpiry) IsExpired() bool {
-	if v.expiresAt.IsZero() {
-		return false
+	fields := []Value{
+		BulkStringValue("server"), BulkStringValue("rodis"),
+		BulkStringValue("version"), BulkStringValue("0.0.1"),
+		BulkStringValue("proto"), IntegerValue(int64(protocol)),
+		BulkStringValue("id"), IntegerValue(0),
+		BulkStringValue("mode"), BulkStringValue("standalone"),
+		BulkStringValue("role"), BulkStringValue("master"),
+		BulkStringValue("modules"), ArrayValue([]Value{}),
 	}
-	return v.expiresAt.Before(time.Now())
+	return Value{typ: Map, array: fields}
 }
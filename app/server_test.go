@@ -30,3 +30,45 @@ func TestDecodeSimpleString(t *testing.T) {
 		t.Errorf("expected 'foo', got '%s'", value.String())
 	}
 }
+
+func TestDecodeRESP3Types(t *testing.T) {
+	cases := []struct {
+		name string
+		in   string
+		typ  Type
+	}{
+		{"integer", ":1000\r\n", Integer},
+		{"error", "-ERR bad\r\n", Error},
+		{"null", "_\r\n", Null},
+		{"double", ",3.14\r\n", Double},
+		{"boolean", "#t\r\n", Boolean},
+		{"bignumber", "(3492890328409238509324850943850943825024385\r\n", BigNumber},
+		{"bulkerror", "!21\r\nSYNTAX invalid syntax\r\n", BulkError},
+		{"verbatim", "=15\r\ntxt:Some string\r\n", VerbatimString},
+		{"map", "%1\r\n$3\r\nkey\r\n$3\r\nval\r\n", Map},
+		{"set", "~2\r\n:1\r\n:2\r\n", Set},
+		{"push", ">1\r\n+hi\r\n", Push},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			value, err := DecodeRESP(bufio.NewReader(bytes.NewBufferString(tc.in)))
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if value.typ != tc.typ {
+				t.Errorf("expected type %q, got %q", byte(tc.typ), byte(value.typ))
+			}
+		})
+	}
+}
+
+func TestHelloNegotiatesProtocol(t *testing.T) {
+	client := NewClient(nil)
+	reply := handleHello(client, []Value{BulkStringValue("3")})
+	if client.protocol != 3 {
+		t.Errorf("expected protocol 3, got %d", client.protocol)
+	}
+	if reply.typ != Map {
+		t.Errorf("expected Map reply, got %q", byte(reply.typ))
+	}
+}
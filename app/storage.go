@@ -0,0 +1,368 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"hash/fnv"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// numShards controls how many independent locks Storage splits its keyspace
+// across. Picked as a fixed power of two so FNV hashing can pick a shard
+// with a cheap mask.
+const numShards = 32
+
+// expireSampleSize and expireSampleThreshold mirror Redis's probabilistic
+// active expiration: sample a handful of keys, and if "too many" turned out
+// to be expired, assume there are more and sample again immediately instead
+// of waiting for the next tick.
+const (
+	expireSampleSize      = 20
+	expireSampleThreshold = 0.25
+)
+
+// ErrWrongType is returned when a command addresses a key that holds a
+// different type than the one it expects, mirroring Redis's WRONGTYPE error.
+var ErrWrongType = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+
+// ValueType tags which field of ValueWithExpiry is live.
+type ValueType int
+
+const (
+	StringVal ValueType = iota
+	ListVal
+	HashVal
+	SetVal
+	ZSetVal
+)
+
+// ValueWithExpiry is a tagged union of every type a key can hold, plus an
+// optional absolute expiry. Only the field matching typ is populated.
+type ValueWithExpiry struct {
+	typ       ValueType
+	str       string
+	list      *list.List
+	hash      map[string]string
+	set       map[string]struct{}
+	zset      *ZSet
+	expiresAt time.Time
+}
+
+func (v ValueWithExpiry) IsExpired() bool {
+	if v.expiresAt.IsZero() {
+		return false
+	}
+	return v.expiresAt.Before(time.Now())
+}
+
+type shard struct {
+	mu   sync.RWMutex
+	data map[string]ValueWithExpiry
+}
+
+// Storage is a sharded key/value store safe for concurrent use by every
+// goroutine handleConnection spawns. Keys are assigned to shards by FNV hash
+// so unrelated keys rarely contend on the same mutex, and a background
+// goroutine actively evicts expired keys instead of relying solely on the
+// passive check in Get.
+// KeyspaceNotifier is told about every write and expiration Storage applies,
+// so a subsystem like PubSub can turn them into __keyspace@0__/__keyevent@0__
+// messages when notify-keyspace-events is enabled.
+type KeyspaceNotifier interface {
+	Notify(event, key string)
+}
+
+type Storage struct {
+	shards   []*shard
+	dirty    int64 // changes since the last successful save, for the save policy
+	notifier atomic.Pointer[KeyspaceNotifier]
+
+	versionMu sync.Mutex
+	versions  map[string]int64 // bumped on every write, read by WATCH/EXEC
+}
+
+func NewStorage() *Storage {
+	s := &Storage{shards: make([]*shard, numShards), versions: make(map[string]int64)}
+	for i := range s.shards {
+		s.shards[i] = &shard{data: make(map[string]ValueWithExpiry)}
+	}
+	go s.activeExpireCycle()
+	return s
+}
+
+// bumpVersion records that key was written to, invalidating any WATCH taken
+// on it before this call.
+func (s *Storage) bumpVersion(key string) {
+	s.versionMu.Lock()
+	s.versions[key]++
+	s.versionMu.Unlock()
+}
+
+// Version returns the number of writes key has seen so far (0 if it has
+// never been written), used by WATCH to snapshot a baseline and by EXEC to
+// detect whether a watched key changed since.
+func (s *Storage) Version(key string) int64 {
+	s.versionMu.Lock()
+	defer s.versionMu.Unlock()
+	return s.versions[key]
+}
+
+// SetNotifier wires a KeyspaceNotifier that is told about subsequent writes
+// and expirations. Safe to call concurrently with the background expiration
+// goroutine started by NewStorage.
+func (s *Storage) SetNotifier(n KeyspaceNotifier) {
+	s.notifier.Store(&n)
+}
+
+func (s *Storage) notify(event, key string) {
+	if p := s.notifier.Load(); p != nil && *p != nil {
+		(*p).Notify(event, key)
+	}
+}
+
+func (s *Storage) shardFor(key string) *shard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return s.shards[h.Sum32()%uint32(numShards)]
+}
+
+func (s *Storage) Set(key string, value string) {
+	sh := s.shardFor(key)
+	sh.mu.Lock()
+	sh.data[key] = ValueWithExpiry{typ: StringVal, str: value}
+	sh.mu.Unlock()
+	atomic.AddInt64(&s.dirty, 1)
+	s.bumpVersion(key)
+	s.notify("set", key)
+}
+
+func (s *Storage) SetWithExpiry(key string, value string, expiry time.Duration) {
+	sh := s.shardFor(key)
+	sh.mu.Lock()
+	sh.data[key] = ValueWithExpiry{
+		typ:       StringVal,
+		str:       value,
+		expiresAt: time.Now().Add(expiry),
+	}
+	sh.mu.Unlock()
+	atomic.AddInt64(&s.dirty, 1)
+	s.bumpVersion(key)
+	s.notify("set", key)
+}
+
+// Restore inserts a key holding any type with an absolute expiry time (zero
+// meaning "no expiry"), bypassing the dirty counter. It is used to repopulate
+// Storage from an RDB snapshot or AOF replay on startup, which must not count
+// as fresh writes against the save policy.
+func (s *Storage) Restore(key string, v ValueWithExpiry) {
+	sh := s.shardFor(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	sh.data[key] = v
+}
+
+func (s *Storage) Get(key string) (string, bool) {
+	v, ok := s.get(key)
+	if !ok || v.typ != StringVal {
+		return "", false
+	}
+	return v.str, true
+}
+
+// get fetches the live (non-expired) raw entry for key, applying passive
+// expiration and notifying on it. Every type-specific accessor below is
+// built on top of this.
+func (s *Storage) get(key string) (ValueWithExpiry, bool) {
+	sh := s.shardFor(key)
+	sh.mu.RLock()
+	v, ok := sh.data[key]
+	sh.mu.RUnlock()
+	if !ok {
+		return ValueWithExpiry{}, false
+	}
+	if v.IsExpired() {
+		sh.mu.Lock()
+		// Re-check: another goroutine may have already deleted or
+		// overwritten the key between the RUnlock above and this Lock.
+		if v, ok := sh.data[key]; ok && v.IsExpired() {
+			delete(sh.data, key)
+		}
+		sh.mu.Unlock()
+		s.notify("expired", key)
+		return ValueWithExpiry{}, false
+	}
+	return v, true
+}
+
+// getForRead fetches the live (non-expired) entry for key and returns its
+// shard still RLocked, so a caller whose value holds a pointer or map
+// (list/hash/set/zset) can safely read through it before releasing the
+// lock, instead of racing a concurrent writer the way a plain get/unlock
+// would. The caller must RUnlock the returned shard; a false ok means no
+// lock was taken.
+func (s *Storage) getForRead(key string) (*shard, ValueWithExpiry, bool) {
+	sh := s.shardFor(key)
+	sh.mu.RLock()
+	v, ok := sh.data[key]
+	if !ok || v.IsExpired() {
+		sh.mu.RUnlock()
+		return nil, ValueWithExpiry{}, false
+	}
+	return sh, v, true
+}
+
+// Del removes key and reports whether it was present.
+func (s *Storage) Del(key string) bool {
+	sh := s.shardFor(key)
+	sh.mu.Lock()
+	if _, ok := sh.data[key]; !ok {
+		sh.mu.Unlock()
+		return false
+	}
+	delete(sh.data, key)
+	sh.mu.Unlock()
+	atomic.AddInt64(&s.dirty, 1)
+	s.bumpVersion(key)
+	s.notify("del", key)
+	return true
+}
+
+// Dirty returns how many writes have happened since the last ResetDirty
+// call, used by the save policy to decide when a BGSAVE is due.
+func (s *Storage) Dirty() int64 {
+	return atomic.LoadInt64(&s.dirty)
+}
+
+func (s *Storage) ResetDirty() {
+	atomic.StoreInt64(&s.dirty, 0)
+}
+
+// Clear empties every shard. It is used by a replica applying a full
+// resync, which must start from nothing before loading the master's RDB.
+func (s *Storage) Clear() {
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+		sh.data = make(map[string]ValueWithExpiry)
+		sh.mu.Unlock()
+	}
+}
+
+// Snapshot returns a point-in-time copy of every live key and its
+// ValueWithExpiry, for RDB save and AOF rewrite to walk without holding any
+// shard lock for the whole dump.
+func (s *Storage) Snapshot() map[string]ValueWithExpiry {
+	out := make(map[string]ValueWithExpiry)
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		for key, v := range sh.data {
+			if !v.IsExpired() {
+				out[key] = v
+			}
+		}
+		sh.mu.RUnlock()
+	}
+	return out
+}
+
+// Len returns the number of live (non-expired) keys across all shards.
+func (s *Storage) Len() int {
+	total := 0
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		for _, v := range sh.data {
+			if !v.IsExpired() {
+				total++
+			}
+		}
+		sh.mu.RUnlock()
+	}
+	return total
+}
+
+// Keys returns every live key matching a glob pattern (*, ?, [...]), as
+// understood by path/filepath.Match.
+func (s *Storage) Keys(pattern string) []string {
+	var keys []string
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		for key, v := range sh.data {
+			if v.IsExpired() {
+				continue
+			}
+			if ok, err := filepath.Match(pattern, key); err == nil && ok {
+				keys = append(keys, key)
+			}
+		}
+		sh.mu.RUnlock()
+	}
+	return keys
+}
+
+// activeExpireCycle periodically samples a handful of keys per shard and
+// evicts the expired ones, so keys that are never Get again still get
+// reclaimed. It mirrors Redis's approach: keep resampling a shard as long as
+// a large fraction of the sample was expired, since that suggests more
+// expired keys remain.
+func (s *Storage) activeExpireCycle() {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, sh := range s.shards {
+			sh.expireSample(s.notify)
+		}
+	}
+}
+
+func (sh *shard) expireSample(notify func(event, key string)) {
+	for {
+		sh.mu.Lock()
+		sampled, expired := 0, 0
+		var expiredKeys []string
+		for key, v := range sh.data {
+			if sampled >= expireSampleSize {
+				break
+			}
+			sampled++
+			if v.IsExpired() {
+				delete(sh.data, key)
+				expiredKeys = append(expiredKeys, key)
+				expired++
+			}
+		}
+		sh.mu.Unlock()
+		for _, key := range expiredKeys {
+			notify("expired", key)
+		}
+		if sampled == 0 || float64(expired)/float64(sampled) <= expireSampleThreshold {
+			return
+		}
+	}
+}
+
+// clampRange turns a Redis-style possibly-negative [start, stop] index pair
+// (­1 meaning the last element) into valid slice bounds for a sequence of
+// length n, reporting false if the resulting range is empty.
+func clampRange(start, stop, n int) (int, int, bool) {
+	if n == 0 {
+		return 0, 0, false
+	}
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	if start > stop || start >= n {
+		return 0, 0, false
+	}
+	return start, stop, true
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStorageConcurrentAccess(t *testing.T) {
+	storage := NewStorage()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := "key" + strconv.Itoa(i%10)
+			storage.Set(key, strconv.Itoa(i))
+			storage.Get(key)
+		}(i)
+	}
+	wg.Wait()
+
+	if storage.Len() == 0 {
+		t.Errorf("expected some keys to remain after concurrent writes")
+	}
+}
+
+// TestStorageConcurrentCollectionAccess exercises concurrent writers and
+// readers against the same list/hash/set key. Reading these types without
+// holding the shard lock for the duration of the read races container/list
+// and the plain maps backing hash/set, which go test -race catches and
+// which can otherwise crash the whole process (not just the goroutine) on a
+// concurrent map read/write.
+func TestStorageConcurrentCollectionAccess(t *testing.T) {
+	storage := NewStorage()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			storage.RPush("list", strconv.Itoa(i))
+			storage.LRange("list", 0, -1)
+			storage.HSet("hash", map[string]string{"field": strconv.Itoa(i)})
+			storage.HGetAll("hash")
+			storage.SAdd("set", strconv.Itoa(i))
+			storage.SMembers("set")
+		}(i)
+	}
+	wg.Wait()
+
+	if n, _ := storage.LLen("list"); n != 50 {
+		t.Errorf("expected 50 list elements, got %d", n)
+	}
+}
+
+func TestStorageExpiration(t *testing.T) {
+	storage := NewStorage()
+	storage.SetWithExpiry("foo", "bar", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	if _, found := storage.Get("foo"); found {
+		t.Errorf("expected expired key to be gone")
+	}
+}
+
+func TestStorageDelAndKeys(t *testing.T) {
+	storage := NewStorage()
+	storage.Set("foo", "1")
+	storage.Set("bar", "2")
+
+	if matches := storage.Keys("foo"); len(matches) != 1 {
+		t.Errorf("expected 1 match for 'foo', got %d", len(matches))
+	}
+
+	if !storage.Del("foo") {
+		t.Errorf("expected Del to report the key existed")
+	}
+	if storage.Del("foo") {
+		t.Errorf("expected Del to report the key no longer existed")
+	}
+	if _, found := storage.Get("foo"); found {
+		t.Errorf("expected deleted key to be gone")
+	}
+}
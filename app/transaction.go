@@ -0,0 +1,101 @@
+package main
+
+// multiState is the per-client MULTI/EXEC/WATCH bookkeeping: the queue of
+// commands collected between MULTI and EXEC, and the storage versions any
+// watched keys had when WATCH was called.
+type multiState struct {
+	active  bool
+	dirty   bool // a queued command failed validation; EXEC must abort
+	queue   []queuedCommand
+	watched map[string]int64
+}
+
+// queuedCommand is one command collected between MULTI and EXEC: its name
+// and parsed arguments for the handler, plus the original decoded RESP
+// array so EXEC can propagate it to the AOF/replicas unchanged.
+type queuedCommand struct {
+	name string
+	args []Value
+	full Value
+}
+
+// handleMulti puts the client into the queuing state: every following
+// command (other than EXEC/DISCARD/WATCH/UNWATCH/MULTI itself) is validated
+// and appended to the queue, replying +QUEUED, instead of running
+// immediately.
+func handleMulti(c *Client, args []Value) Value {
+	if c.multi.active {
+		return ErrorValue("ERR MULTI calls can not be nested")
+	}
+	c.multi = multiState{active: true, watched: c.multi.watched}
+	return SimpleStringValue("OK")
+}
+
+// handleDiscard drops the queued commands and any watches, leaving the
+// client outside a transaction.
+func handleDiscard(c *Client, args []Value) Value {
+	if !c.multi.active {
+		return ErrorValue("ERR DISCARD without MULTI")
+	}
+	c.multi = multiState{}
+	return SimpleStringValue("OK")
+}
+
+// handleWatch records the current version of each named key, so EXEC can
+// tell whether any of them changed in the meantime.
+func handleWatch(c *Client, storage *Storage, args []Value) Value {
+	if c.multi.active {
+		return ErrorValue("ERR WATCH inside MULTI is not allowed")
+	}
+	if c.multi.watched == nil {
+		c.multi.watched = make(map[string]int64)
+	}
+	for _, arg := range args {
+		key := arg.String()
+		c.multi.watched[key] = storage.Version(key)
+	}
+	return SimpleStringValue("OK")
+}
+
+// handleUnwatch forgets every key WATCH has recorded for this client.
+func handleUnwatch(c *Client, args []Value) Value {
+	c.multi.watched = nil
+	return SimpleStringValue("OK")
+}
+
+// handleExec runs every queued command under server.execMu, the same lock
+// handleConnection takes around every ordinary write command, so the whole
+// batch is atomic with respect to both other EXECs and concurrent single
+// commands. It then returns the array of individual replies. If a queued
+// command failed validation it aborts with EXECABORT; if any watched key
+// changed since WATCH, it aborts with a null array instead of running
+// anything.
+func handleExec(c *Client, server *Server) Value {
+	if !c.multi.active {
+		return ErrorValue("ERR EXEC without MULTI")
+	}
+	queue, watched, dirty := c.multi.queue, c.multi.watched, c.multi.dirty
+	c.multi = multiState{}
+
+	if dirty {
+		return ErrorValue("EXECABORT Transaction discarded because of previous errors.")
+	}
+
+	server.execMu.Lock()
+	defer server.execMu.Unlock()
+
+	for key, version := range watched {
+		if server.storage.Version(key) != version {
+			return NullArrayValue()
+		}
+	}
+
+	replies := make([]Value, len(queue))
+	for i, cmd := range queue {
+		spec := server.commands[cmd.name]
+		reply := spec.Handler(c, cmd.args)
+		replies[i] = reply
+		propagate(server, spec, cmd.full, reply)
+	}
+	return ArrayValue(replies)
+}
@@ -0,0 +1,362 @@
+package main
+
+import "math/rand"
+
+// zsetMaxLevel and zsetP are the classic skiplist tuning constants Redis
+// itself uses: a tower of up to 32 forward pointers per node, each level half
+// as likely to exist as the one below it.
+const (
+	zsetMaxLevel = 32
+	zsetP        = 0.25
+)
+
+// zskiplistLevel is one rung of a node's forward-pointer tower: where it
+// points, and the span (how many nodes, including the destination, that
+// pointer skips over). Spans are what let rank/range queries descend the
+// tower instead of walking level 0 one node at a time.
+type zskiplistLevel struct {
+	forward *zskiplistNode
+	span    int
+}
+
+type zskiplistNode struct {
+	member string
+	score  float64
+	level  []zskiplistLevel
+}
+
+// zskiplist keeps (score, member) pairs in ascending order, ties broken by
+// member, via a probabilistic tower of forward pointers per node.
+type zskiplist struct {
+	header *zskiplistNode
+	level  int
+	length int
+}
+
+func newZskiplist() *zskiplist {
+	return &zskiplist{
+		header: &zskiplistNode{level: make([]zskiplistLevel, zsetMaxLevel)},
+		level:  1,
+	}
+}
+
+func randomLevel() int {
+	level := 1
+	for level < zsetMaxLevel && rand.Float64() < zsetP {
+		level++
+	}
+	return level
+}
+
+func zsetLess(score1 float64, member1 string, score2 float64, member2 string) bool {
+	if score1 != score2 {
+		return score1 < score2
+	}
+	return member1 < member2
+}
+
+func (zsl *zskiplist) insert(score float64, member string) {
+	update := make([]*zskiplistNode, zsetMaxLevel)
+	rank := make([]int, zsetMaxLevel)
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		if i == zsl.level-1 {
+			rank[i] = 0
+		} else {
+			rank[i] = rank[i+1]
+		}
+		for x.level[i].forward != nil && zsetLess(x.level[i].forward.score, x.level[i].forward.member, score, member) {
+			rank[i] += x.level[i].span
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	level := randomLevel()
+	if level > zsl.level {
+		for i := zsl.level; i < level; i++ {
+			rank[i] = 0
+			update[i] = zsl.header
+			update[i].level[i].span = zsl.length
+		}
+		zsl.level = level
+	}
+
+	node := &zskiplistNode{member: member, score: score, level: make([]zskiplistLevel, level)}
+	for i := 0; i < level; i++ {
+		node.level[i].forward = update[i].level[i].forward
+		update[i].level[i].forward = node
+
+		node.level[i].span = update[i].level[i].span - (rank[0] - rank[i])
+		update[i].level[i].span = rank[0] - rank[i] + 1
+	}
+
+	// Levels above the new node's tower that weren't touched just gained one
+	// more node somewhere beneath them; their span grows by one to match.
+	for i := level; i < zsl.level; i++ {
+		update[i].level[i].span++
+	}
+	zsl.length++
+}
+
+func (zsl *zskiplist) delete(score float64, member string) {
+	update := make([]*zskiplistNode, zsetMaxLevel)
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && zsetLess(x.level[i].forward.score, x.level[i].forward.member, score, member) {
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	x = x.level[0].forward
+	if x == nil || x.score != score || x.member != member {
+		return
+	}
+	for i := 0; i < zsl.level; i++ {
+		if update[i].level[i].forward == x {
+			update[i].level[i].span += x.level[i].span - 1
+			update[i].level[i].forward = x.level[i].forward
+		} else {
+			update[i].level[i].span--
+		}
+	}
+	for zsl.level > 1 && zsl.header.level[zsl.level-1].forward == nil {
+		zsl.level--
+	}
+	zsl.length--
+}
+
+// rank descends the tower summing spans instead of walking level 0, and
+// returns member's 1-based position (0 if it isn't found).
+func (zsl *zskiplist) rank(score float64, member string) int {
+	x := zsl.header
+	rank := 0
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil &&
+			zsetLess(x.level[i].forward.score, x.level[i].forward.member, score, member) {
+			rank += x.level[i].span
+			x = x.level[i].forward
+		}
+	}
+	x = x.level[0].forward
+	if x != nil && x.score == score && x.member == member {
+		return rank + 1
+	}
+	return 0
+}
+
+// all walks the bottom level, which always holds every node in order. It
+// exists for tests; Range/RangeByScore/Rank descend the tower instead so
+// they don't pay this O(n) cost on every query.
+func (zsl *zskiplist) all() []*zskiplistNode {
+	nodes := make([]*zskiplistNode, 0, zsl.length)
+	for x := zsl.header.level[0].forward; x != nil; x = x.level[0].forward {
+		nodes = append(nodes, x)
+	}
+	return nodes
+}
+
+// byRank descends the tower to the node at the given 1-based rank, or nil if
+// rank is out of [1, length].
+func (zsl *zskiplist) byRank(rank int) *zskiplistNode {
+	x := zsl.header
+	traversed := 0
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && traversed+x.level[i].span <= rank {
+			traversed += x.level[i].span
+			x = x.level[i].forward
+		}
+		if traversed == rank {
+			return x
+		}
+	}
+	return nil
+}
+
+// firstInRange descends the tower to the first node with score >= min, or
+// nil if every node's score is below min.
+func (zsl *zskiplist) firstInRange(min float64) *zskiplistNode {
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && x.level[i].forward.score < min {
+			x = x.level[i].forward
+		}
+	}
+	return x.level[0].forward
+}
+
+// ZSet pairs a zskiplist (for ordered range/rank queries) with a plain map
+// (for O(1) score lookups by member), the same split Redis itself uses.
+type ZSet struct {
+	scores map[string]float64
+	zsl    *zskiplist
+}
+
+func newZSet() *ZSet {
+	return &ZSet{scores: make(map[string]float64), zsl: newZskiplist()}
+}
+
+// Add sets member's score, reporting whether member is new to the set.
+func (z *ZSet) Add(member string, score float64) bool {
+	old, exists := z.scores[member]
+	if exists {
+		if old == score {
+			return false
+		}
+		z.zsl.delete(old, member)
+	}
+	z.zsl.insert(score, member)
+	z.scores[member] = score
+	return !exists
+}
+
+// IncrBy adds delta to member's current score (0 if absent) and returns the
+// result.
+func (z *ZSet) IncrBy(member string, delta float64) float64 {
+	score := z.scores[member] + delta
+	z.Add(member, score)
+	return score
+}
+
+func (z *ZSet) Score(member string) (float64, bool) {
+	score, ok := z.scores[member]
+	return score, ok
+}
+
+func (z *ZSet) Len() int {
+	return len(z.scores)
+}
+
+// Range returns members in ascending score order for the inclusive rank
+// range [start, stop], with Redis's negative-index convention (-1 is last).
+// It descends the skiplist's tower to the start rank, then walks level 0
+// forward for the remaining stop-start elements, rather than materializing
+// every member in the set.
+func (z *ZSet) Range(start, stop int) []string {
+	start, stop, ok := clampRange(start, stop, z.zsl.length)
+	if !ok {
+		return nil
+	}
+	members := make([]string, 0, stop-start+1)
+	for n := z.zsl.byRank(start + 1); n != nil && len(members) <= stop-start; n = n.level[0].forward {
+		members = append(members, n.member)
+	}
+	return members
+}
+
+// RangeByScore returns every member whose score falls within [min, max], in
+// ascending score order. It descends the tower to the first member scoring
+// at least min, then walks level 0 forward until max is exceeded.
+func (z *ZSet) RangeByScore(min, max float64) []string {
+	var members []string
+	for n := z.zsl.firstInRange(min); n != nil && n.score <= max; n = n.level[0].forward {
+		members = append(members, n.member)
+	}
+	return members
+}
+
+// Rank returns member's 0-based position in ascending score order.
+func (z *ZSet) Rank(member string) (int, bool) {
+	score, ok := z.scores[member]
+	if !ok {
+		return 0, false
+	}
+	rank := z.zsl.rank(score, member)
+	if rank == 0 {
+		return 0, false
+	}
+	return rank - 1, true
+}
+
+// Sorted set commands on Storage. Backed by a ZSet per key.
+
+// ZAdd sets each member's score, reporting how many members were new.
+func (s *Storage) ZAdd(key string, members map[string]float64) (int, error) {
+	sh := s.shardFor(key)
+	sh.mu.Lock()
+	v, ok := sh.data[key]
+	if ok && v.IsExpired() {
+		ok = false
+	}
+	if !ok {
+		v = ValueWithExpiry{typ: ZSetVal, zset: newZSet()}
+	} else if v.typ != ZSetVal {
+		sh.mu.Unlock()
+		return 0, ErrWrongType
+	}
+	added := 0
+	for member, score := range members {
+		if v.zset.Add(member, score) {
+			added++
+		}
+	}
+	sh.data[key] = v
+	sh.mu.Unlock()
+	s.markDirty(key, "zadd")
+	return added, nil
+}
+
+// ZRange returns members in ascending score order for the (possibly
+// negative) rank range [start, stop], inclusive.
+func (s *Storage) ZRange(key string, start, stop int) ([]string, error) {
+	sh, v, ok := s.getForRead(key)
+	if !ok {
+		return nil, nil
+	}
+	defer sh.mu.RUnlock()
+	if v.typ != ZSetVal {
+		return nil, ErrWrongType
+	}
+	return v.zset.Range(start, stop), nil
+}
+
+// ZRangeByScore returns members whose score falls within [min, max], in
+// ascending score order.
+func (s *Storage) ZRangeByScore(key string, min, max float64) ([]string, error) {
+	sh, v, ok := s.getForRead(key)
+	if !ok {
+		return nil, nil
+	}
+	defer sh.mu.RUnlock()
+	if v.typ != ZSetVal {
+		return nil, ErrWrongType
+	}
+	return v.zset.RangeByScore(min, max), nil
+}
+
+// ZRank returns member's 0-based rank in ascending score order.
+func (s *Storage) ZRank(key, member string) (int, bool, error) {
+	sh, v, ok := s.getForRead(key)
+	if !ok {
+		return 0, false, nil
+	}
+	defer sh.mu.RUnlock()
+	if v.typ != ZSetVal {
+		return 0, false, ErrWrongType
+	}
+	rank, ok := v.zset.Rank(member)
+	return rank, ok, nil
+}
+
+// ZIncrBy adds delta to member's current score (0 if absent) and returns the
+// result.
+func (s *Storage) ZIncrBy(key, member string, delta float64) (float64, error) {
+	sh := s.shardFor(key)
+	sh.mu.Lock()
+	v, ok := sh.data[key]
+	if ok && v.IsExpired() {
+		ok = false
+	}
+	if !ok {
+		v = ValueWithExpiry{typ: ZSetVal, zset: newZSet()}
+	} else if v.typ != ZSetVal {
+		sh.mu.Unlock()
+		return 0, ErrWrongType
+	}
+	result := v.zset.IncrBy(member, delta)
+	sh.data[key] = v
+	sh.mu.Unlock()
+	s.markDirty(key, "zincrby")
+	return result, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+)
+
+func TestZSetAddRangeRank(t *testing.T) {
+	storage := NewStorage()
+	storage.ZAdd("leaderboard", map[string]float64{"alice": 10, "bob": 20, "carol": 5})
+
+	members, err := storage.ZRange("leaderboard", 0, -1)
+	if err != nil {
+		t.Fatalf("ZRange failed: %s", err)
+	}
+	want := []string{"carol", "alice", "bob"}
+	for i, w := range want {
+		if members[i] != w {
+			t.Fatalf("expected %v, got %v", want, members)
+		}
+	}
+
+	rank, found, err := storage.ZRank("leaderboard", "alice")
+	if err != nil || !found || rank != 1 {
+		t.Errorf("expected alice at rank 1, got %d found=%v err=%v", rank, found, err)
+	}
+
+	byScore, err := storage.ZRangeByScore("leaderboard", 6, 15)
+	if err != nil || len(byScore) != 1 || byScore[0] != "alice" {
+		t.Errorf("expected only alice in [6,15], got %v err=%v", byScore, err)
+	}
+}
+
+func TestZSetIncrBy(t *testing.T) {
+	storage := NewStorage()
+	storage.ZAdd("scores", map[string]float64{"alice": 10})
+
+	result, err := storage.ZIncrBy("scores", "alice", 5)
+	if err != nil || result != 15 {
+		t.Errorf("expected 15, got %v err=%v", result, err)
+	}
+}
+
+func TestSkiplistInsertAndDelete(t *testing.T) {
+	zsl := newZskiplist()
+	zsl.insert(3, "c")
+	zsl.insert(1, "a")
+	zsl.insert(2, "b")
+
+	nodes := zsl.all()
+	want := []string{"a", "b", "c"}
+	for i, w := range want {
+		if nodes[i].member != w {
+			t.Fatalf("expected order %v, got %v", want, nodes)
+		}
+	}
+
+	zsl.delete(2, "b")
+	if zsl.length != 2 {
+		t.Errorf("expected length 2 after delete, got %d", zsl.length)
+	}
+	for _, n := range zsl.all() {
+		if n.member == "b" {
+			t.Errorf("expected 'b' to be removed")
+		}
+	}
+}
+
+// TestZSetRangeAndRankAgainstNaiveOrdering inserts and deletes enough
+// members to build a multi-level tower, then checks Range/RangeByScore/Rank
+// (which descend the tower summing spans) against a plain sorted slice, to
+// make sure the span bookkeeping in insert/delete stays correct at every
+// level, not just level 0.
+func TestZSetRangeAndRankAgainstNaiveOrdering(t *testing.T) {
+	z := newZSet()
+	const n = 500
+
+	type pair struct {
+		member string
+		score  float64
+	}
+	var alive []pair
+	for i := 0; i < n; i++ {
+		member := fmt.Sprintf("member-%d", i)
+		score := float64((i*7919)%997) + float64(i)/1000 // spread scores, keep members ordering stable on ties
+		z.Add(member, score)
+		alive = append(alive, pair{member, score})
+
+		if i%3 == 0 && len(alive) > 0 {
+			victim := alive[i%len(alive)]
+			z.zsl.delete(victim.score, victim.member)
+			delete(z.scores, victim.member)
+			for j, p := range alive {
+				if p.member == victim.member {
+					alive = append(alive[:j], alive[j+1:]...)
+					break
+				}
+			}
+		}
+	}
+
+	sort.Slice(alive, func(i, j int) bool {
+		return zsetLess(alive[i].score, alive[i].member, alive[j].score, alive[j].member)
+	})
+
+	if z.Len() != len(alive) {
+		t.Fatalf("expected %d live members, got %d", len(alive), z.Len())
+	}
+
+	got := z.Range(0, -1)
+	if len(got) != len(alive) {
+		t.Fatalf("expected Range(0,-1) to return %d members, got %d", len(alive), len(got))
+	}
+	for i, p := range alive {
+		if got[i] != p.member {
+			t.Fatalf("Range mismatch at %d: expected %q, got %q", i, p.member, got[i])
+		}
+		rank, ok := z.Rank(p.member)
+		if !ok || rank != i {
+			t.Fatalf("expected %q at rank %d, got %d ok=%v", p.member, i, rank, ok)
+		}
+	}
+
+	min, max := 100.0, 300.0
+	var want []string
+	for _, p := range alive {
+		if p.score >= min && p.score <= max {
+			want = append(want, p.member)
+		}
+	}
+	byScore := z.RangeByScore(min, max)
+	if len(byScore) != len(want) {
+		t.Fatalf("expected %d members in [%v,%v], got %d", len(want), min, max, len(byScore))
+	}
+	for i, w := range want {
+		if byScore[i] != w {
+			t.Fatalf("RangeByScore mismatch at %d: expected %q, got %q", i, w, byScore[i])
+		}
+	}
+}